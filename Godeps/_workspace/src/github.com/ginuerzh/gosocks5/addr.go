@@ -0,0 +1,325 @@
+package gosocks5
+
+import (
+	"context"
+	"golang.org/x/net/idna"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseAddr parses a "host:port" string into an Addr, inferring the address
+// type from host. An IPv6 zone ("[fe80::1%eth0]:80") is split off into Zone.
+func ParseAddr(s string) (*Addr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := &Addr{
+		Host: host,
+		Port: uint16(p),
+	}
+	if i := strings.LastIndexByte(host, '%'); i >= 0 && net.ParseIP(host[:i]) != nil {
+		addr.Host, addr.Zone = host[:i], host[i+1:]
+	}
+
+	addr.Type = AddrTypeOf(addr.Host)
+
+	return addr, nil
+}
+
+// AddrTypeOf returns the address type of host, a bare host without port or
+// IPv6 zone: AddrIPv4 or AddrIPv6 for an IP literal, and AddrDomain for
+// anything net.ParseIP cannot parse.
+func AddrTypeOf(host string) uint8 {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return AddrDomain
+	case ip.To4() != nil:
+		return AddrIPv4
+	}
+	return AddrIPv6
+}
+
+// ParseAddrASCII is like ParseAddr, but converts an internationalized domain
+// name to its ASCII (punycode) form before storing it.
+func ParseAddrASCII(s string) (*Addr, error) {
+	addr, err := ParseAddr(s)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Host, err = addr.ASCII(); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// NewAddrFromNetAddr converts a net.Addr, typically a *net.TCPAddr or
+// *net.UDPAddr, into an Addr. A *net.UnixAddr yields an AddrUnix address.
+func NewAddrFromNetAddr(a net.Addr) (*Addr, error) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return ipAddr(a.IP, a.Port, a.Zone), nil
+	case *net.UDPAddr:
+		return ipAddr(a.IP, a.Port, a.Zone), nil
+	case *net.UnixAddr:
+		return &Addr{Type: AddrUnix, Host: a.Name}, nil
+	}
+	return ParseAddr(a.String())
+}
+
+// NewIPAddr returns the Addr of ip and port, without the string round trip
+// of ParseAddr. An IPv4-mapped IPv6 ip yields an AddrIPv4 address.
+func NewIPAddr(ip net.IP, port uint16) *Addr {
+	addr := &Addr{
+		Type: AddrIPv6,
+		Host: ip.String(),
+		Port: port,
+	}
+	if ip.To4() != nil {
+		addr.Type = AddrIPv4
+	}
+	return addr
+}
+
+func ipAddr(ip net.IP, port int, zone string) *Addr {
+	addr := NewIPAddr(ip, uint16(port))
+	addr.Zone = zone
+	return addr
+}
+
+// Normalize reclassifies a domain address whose host is in fact an IP
+// literal, as some clients send, as an IPv4 or IPv6 address, and reports
+// whether it did so.
+func (addr *Addr) Normalize() bool {
+	if addr.Type != AddrDomain {
+		return false
+	}
+
+	host, zone := addr.Host, ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	*addr = *ipAddr(ip, int(addr.Port), zone)
+	return true
+}
+
+// TCPAddr converts addr to a *net.TCPAddr, resolving domain names.
+func (addr *Addr) TCPAddr() (*net.TCPAddr, error) {
+	if addr.Type == AddrDomain {
+		n := *addr
+		if !n.Normalize() {
+			return net.ResolveTCPAddr("tcp", addr.String())
+		}
+		addr = &n
+	}
+
+	ip := net.ParseIP(addr.Host)
+	if ip == nil {
+		return nil, ErrBadFormat
+	}
+	return &net.TCPAddr{IP: ip, Port: int(addr.Port), Zone: addr.Zone}, nil
+}
+
+// UDPAddr converts addr to a *net.UDPAddr, resolving domain names.
+func (addr *Addr) UDPAddr() (*net.UDPAddr, error) {
+	if addr.Type == AddrDomain {
+		n := *addr
+		if !n.Normalize() {
+			return net.ResolveUDPAddr("udp", addr.String())
+		}
+		addr = &n
+	}
+
+	ip := net.ParseIP(addr.Host)
+	if ip == nil {
+		return nil, ErrBadFormat
+	}
+	return &net.UDPAddr{IP: ip, Port: int(addr.Port), Zone: addr.Zone}, nil
+}
+
+// UnixAddr converts an AddrUnix address to a *net.UnixAddr of network
+// "unix". Other address types yield ErrBadAddrType.
+func (addr *Addr) UnixAddr() (*net.UnixAddr, error) {
+	if addr.Type != AddrUnix {
+		return nil, ErrBadAddrType
+	}
+	return &net.UnixAddr{Name: addr.Host, Net: "unix"}, nil
+}
+
+// IP returns the IP of an IPv4 or IPv6 address without resolving anything,
+// including that of a domain address whose host is an IP literal, as
+// Normalize would reclassify it. It is nil for any other domain address, or
+// if Host is not a valid IP.
+func (addr *Addr) IP() net.IP {
+	if addr.Type == AddrDomain {
+		n := *addr
+		if !n.Normalize() {
+			return nil
+		}
+		addr = &n
+	}
+	return net.ParseIP(addr.Host)
+}
+
+// LookupIP returns the IPs addr refers to, resolving a domain name with the
+// default resolver.
+func (addr *Addr) LookupIP(ctx context.Context) ([]net.IP, error) {
+	if ip := addr.IP(); ip != nil || addr.Type != AddrDomain {
+		if ip == nil {
+			return nil, ErrBadFormat
+		}
+		return []net.IP{ip}, nil
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip", addr.Host)
+}
+
+// IsLoopback reports whether addr is a loopback IP. It does not resolve
+// domain names and is false for them, unless they are IP literals.
+func (addr *Addr) IsLoopback() bool {
+	ip := addr.IP()
+	return ip != nil && ip.IsLoopback()
+}
+
+// IsPrivate reports whether addr is an IP a public proxy should not let
+// clients reach: a private (RFC 1918, RFC 4193), loopback, link-local or
+// unspecified address. It does not resolve domain names and is false for
+// them, unless they are IP literals; use LookupPrivate to check those.
+func (addr *Addr) IsPrivate() bool {
+	ip := addr.IP()
+	return ip != nil && isPrivateIP(ip)
+}
+
+// LookupPrivate is like IsPrivate, but resolves a domain name and reports
+// whether any of its IPs is private. To keep the name from resolving
+// differently when connecting, dial one of the IPs from LookupIP instead.
+func (addr *Addr) LookupPrivate(ctx context.Context) (bool, error) {
+	ips, err := addr.LookupIP(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// Canonicalize rewrites an IPv4-mapped IPv6 address (::ffff:a.b.c.d) as the
+// IPv4 address it stands for. The mapped form reaches the same host, so an
+// ACL or policy that looks at the address type would otherwise let a client
+// past its IPv4 rules just by sending the target as IPv6.
+func (addr *Addr) Canonicalize() {
+	if !addr.isMappedIPv4() {
+		return
+	}
+	addr.Type = AddrIPv4
+	addr.Host = net.ParseIP(addr.Host).To4().String()
+	addr.Zone = ""
+}
+
+func (addr *Addr) isMappedIPv4() bool {
+	if addr.Type != AddrIPv6 {
+		return false
+	}
+	ip := net.ParseIP(addr.Host)
+	return ip != nil && ip.To4() != nil
+}
+
+// ASCII returns the host of a domain address in the IDNA ASCII (punycode)
+// form suitable for DNS resolution. IP hosts are returned unchanged.
+func (addr *Addr) ASCII() (string, error) {
+	if addr.Type != AddrDomain {
+		return addr.Host, nil
+	}
+	return idna.Lookup.ToASCII(addr.Host)
+}
+
+// Equal reports whether addr and other name the same endpoint. IP hosts are
+// compared after parsing, so an IPv4 address equals its IPv4-mapped IPv6
+// form; domain names are compared case-insensitively. Two nil Addrs are
+// equal, a nil and a non-nil one are not.
+func (addr *Addr) Equal(other *Addr) bool {
+	if addr == nil || other == nil {
+		return addr == other
+	}
+	if addr.Port != other.Port {
+		return false
+	}
+
+	ip, otherIP := net.ParseIP(addr.Host), net.ParseIP(other.Host)
+	if ip != nil && otherIP != nil {
+		return ip.Equal(otherIP) && addr.Zone == other.Zone
+	}
+	if ip != nil || otherIP != nil {
+		return false
+	}
+	return strings.EqualFold(addr.Host, other.Host)
+}
+
+// maxCustomAddrLen bounds the encoded host of a registered address type to
+// the space a domain name takes, so that frames keep their maximum size.
+const maxCustomAddrLen = 1 + 255
+
+type addrType struct {
+	decode func(b []byte) (host string, n int, err error)
+	encode func(host string, b []byte) (int, error)
+}
+
+var addrTypes = map[uint8]addrType{}
+
+// RegisterAddrType adds a codec for the non-standard address type t, which
+// Addr then decodes and encodes instead of rejecting it with ErrBadAddrType.
+// decode parses the host at the start of b, which holds the bytes following
+// ATYP and may go on past the address, returning it and its encoded length n;
+// it returns ErrShortBuffer if b does not hold the whole address yet. encode
+// writes host to b and returns the number of bytes written. The port is
+// handled by Addr as for the standard types, and an encoded host may take at
+// most 256 bytes.
+//
+// The standard types and AddrUnix are built in and cannot be registered.
+// RegisterAddrType is meant to be called from an init function; it is not
+// safe to call while addresses are being decoded or encoded.
+func RegisterAddrType(t uint8, decode func(b []byte) (host string, n int, err error), encode func(host string, b []byte) (int, error)) {
+	switch t {
+	case AddrIPv4, AddrDomain, AddrIPv6, AddrUnix:
+		panic("gosocks5: RegisterAddrType of built-in address type " + strconv.Itoa(int(t)))
+	}
+	addrTypes[t] = addrType{decode: decode, encode: encode}
+}
+
+// len is the addrLen of an address of type at, asking for one more byte at a
+// time while decode reports the address incomplete.
+func (at addrType) len(b []byte) (int, error) {
+	_, n, err := at.decode(b)
+	if err == ErrShortBuffer {
+		if len(b) >= maxCustomAddrLen {
+			return 0, ErrBadFormat
+		}
+		return 1 + len(b) + 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n > maxCustomAddrLen {
+		return 0, ErrBadFormat
+	}
+	return 1 + n + 2, nil
+}
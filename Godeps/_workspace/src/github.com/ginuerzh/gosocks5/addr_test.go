@@ -0,0 +1,365 @@
+package gosocks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAddrIsPrivate(t *testing.T) {
+	tests := []struct {
+		addr     string
+		private  bool
+		loopback bool
+	}{
+		{"8.8.8.8:53", false, false},
+		{"10.1.2.3:80", true, false},
+		{"172.16.0.1:80", true, false},
+		{"192.168.1.1:80", true, false},
+		{"127.0.0.1:80", true, true},
+		{"169.254.169.254:80", true, false},
+		{"0.0.0.0:80", true, false},
+		{"[::1]:80", true, true},
+		{"[fd00::1]:80", true, false},
+		{"[fe80::1%eth0]:80", true, false},
+		{"[::ffff:127.0.0.1]:80", true, true},
+		{"[2001:db8::1]:80", false, false},
+		{"localhost:80", false, false},
+	}
+
+	for _, tt := range tests {
+		addr, err := ParseAddr(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := addr.IsPrivate(); got != tt.private {
+			t.Errorf("%s: IsPrivate() = %t, want %t", tt.addr, got, tt.private)
+		}
+		if got := addr.IsLoopback(); got != tt.loopback {
+			t.Errorf("%s: IsLoopback() = %t, want %t", tt.addr, got, tt.loopback)
+		}
+		if addr.Type == AddrDomain {
+			continue
+		}
+		if got, err := addr.LookupPrivate(context.Background()); err != nil || got != tt.private {
+			t.Errorf("%s: LookupPrivate() = %t, %v, want %t", tt.addr, got, err, tt.private)
+		}
+	}
+
+	// IP literals sent as a domain are dialed as IPs, so must be caught too
+	for _, host := range []string{"127.0.0.1", "10.0.0.1", "::1", "fe80::1%eth0"} {
+		addr := &Addr{Type: AddrDomain, Host: host, Port: 80}
+		if !addr.IsPrivate() {
+			t.Errorf("domain %s: IsPrivate() = false, want true", host)
+		}
+		if got, err := addr.LookupPrivate(context.Background()); err != nil || !got {
+			t.Errorf("domain %s: LookupPrivate() = %t, %v, want true", host, got, err)
+		}
+	}
+	if addr := (&Addr{Type: AddrDomain, Host: "127.0.0.1", Port: 80}); !addr.IsLoopback() {
+		t.Error("domain 127.0.0.1: IsLoopback() = false, want true")
+	}
+}
+
+var benchIP = net.ParseIP("192.0.2.1")
+
+func BenchmarkNewIPAddr(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewIPAddr(benchIP, 443)
+	}
+}
+
+// BenchmarkParseAddrIP builds the same Addr as BenchmarkNewIPAddr the way
+// a caller holding a net.IP had to before NewIPAddr.
+func BenchmarkParseAddrIP(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseAddr(net.JoinHostPort(benchIP.String(), "443"))
+	}
+}
+
+func TestAddrTypeOf(t *testing.T) {
+	tests := []struct {
+		host string
+		want uint8
+	}{
+		{"192.0.2.1", AddrIPv4},
+		{"::ffff:192.0.2.1", AddrIPv4},
+		{"2001:db8::1", AddrIPv6},
+		{"example.com", AddrDomain},
+		{"[2001:db8::1]", AddrDomain},
+		{"", AddrDomain},
+	}
+	for _, tt := range tests {
+		if got := AddrTypeOf(tt.host); got != tt.want {
+			t.Errorf("AddrTypeOf(%q) = %d, want %d", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestAddrStringIPv6(t *testing.T) {
+	frame := []byte{AddrIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}
+	decoded := new(Addr)
+	if err := decoded.Decode(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr *Addr
+		want string
+	}{
+		{&Addr{Type: AddrIPv6, Host: "::1", Port: 80}, "[::1]:80"},
+		{decoded, "[::1]:80"},
+		{&Addr{Type: AddrIPv6, Host: "fe80::1", Port: 80, Zone: "eth0"}, "[fe80::1%eth0]:80"},
+		// an IP literal sent as a domain name
+		{&Addr{Type: AddrDomain, Host: "2001:db8::1", Port: 443}, "[2001:db8::1]:443"},
+	}
+	for _, tt := range tests {
+		if got := tt.addr.String(); got != tt.want {
+			t.Errorf("%+v: String() = %q, want %q", tt.addr, got, tt.want)
+		}
+		if _, _, err := net.SplitHostPort(tt.addr.String()); err != nil {
+			t.Errorf("%+v: String() does not split: %v", tt.addr, err)
+		}
+		if tcp, err := tt.addr.TCPAddr(); err != nil || tcp.String() != tt.want {
+			t.Errorf("%+v: TCPAddr() = %v, %v, want %s", tt.addr, tcp, err, tt.want)
+		}
+		if udp, err := tt.addr.UDPAddr(); err != nil || udp.String() != tt.want {
+			t.Errorf("%+v: UDPAddr() = %v, %v, want %s", tt.addr, udp, err, tt.want)
+		}
+		if parsed, err := ParseAddr(tt.addr.String()); err != nil || parsed.String() != tt.want {
+			t.Errorf("%+v: ParseAddr(String()) = %v, %v", tt.addr, parsed, err)
+		}
+
+		for _, s := range []string{
+			NewRequest(CmdConnect, tt.addr).String(),
+			NewReply(Succeeded, tt.addr).String(),
+			NewUDPHeader(0, 0, tt.addr).String(),
+		} {
+			if !strings.HasSuffix(s, " "+tt.want) {
+				t.Errorf("%+v: frame String() = %q, want it to end in %s", tt.addr, s, tt.want)
+			}
+		}
+	}
+}
+
+func TestNewIPAddr(t *testing.T) {
+	for _, s := range []string{"192.0.2.1:443", "[2001:db8::1]:443"} {
+		want, err := ParseAddr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := NewIPAddr(net.ParseIP(want.Host), want.Port); *got != *want {
+			t.Errorf("NewIPAddr = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestAddrCanonicalize(t *testing.T) {
+	mapped := &Addr{Type: AddrIPv6, Host: "::ffff:127.0.0.1", Port: 80}
+	b, err := mapped.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapped.Canonicalize()
+	if want := (Addr{Type: AddrIPv4, Host: "127.0.0.1", Port: 80}); *mapped != want {
+		t.Errorf("Canonicalize() = %+v, want %+v", *mapped, want)
+	}
+
+	v6 := &Addr{Type: AddrIPv6, Host: "2001:db8::1", Port: 80}
+	v6.Canonicalize()
+	if v6.Type != AddrIPv6 || v6.Host != "2001:db8::1" {
+		t.Errorf("Canonicalize() changed %+v", v6)
+	}
+
+	frame := append([]byte{Ver5, CmdConnect, 0}, b...)
+	if _, err := ReadRequest(bytes.NewReader(frame)); err != nil {
+		t.Errorf("lenient: %v", err)
+	}
+	opts := &DecodeOptions{RejectMappedIPv4: true}
+	if _, err := ReadRequestWithOptions(bytes.NewReader(frame), opts); !errors.Is(err, ErrBadAddrType) {
+		t.Errorf("strict: %v, want %v", err, ErrBadAddrType)
+	}
+}
+
+func TestAddrNormalize(t *testing.T) {
+	tests := []struct {
+		host string
+		want Addr
+		ok   bool
+	}{
+		{"192.0.2.1", Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 80}, true},
+		{"2001:db8::1", Addr{Type: AddrIPv6, Host: "2001:db8::1", Port: 80}, true},
+		{"fe80::1%eth0", Addr{Type: AddrIPv6, Host: "fe80::1", Port: 80, Zone: "eth0"}, true},
+		{"example.com", Addr{Type: AddrDomain, Host: "example.com", Port: 80}, false},
+	}
+
+	for _, tt := range tests {
+		addr := Addr{Type: AddrDomain, Host: tt.host, Port: 80}
+		if ok := addr.Normalize(); ok != tt.ok || addr != tt.want {
+			t.Errorf("Normalize(%s) = %t, %+v, want %t, %+v", tt.host, ok, addr, tt.ok, tt.want)
+		}
+	}
+
+	// TCPAddr takes the IP as is, without a lookup
+	addr := &Addr{Type: AddrDomain, Host: "192.0.2.1", Port: 80}
+	taddr, err := addr.TCPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taddr.String() != "192.0.2.1:80" {
+		t.Errorf("TCPAddr() = %s, want %s", taddr, "192.0.2.1:80")
+	}
+	if addr.Type != AddrDomain {
+		t.Errorf("TCPAddr() changed the address type to %d", addr.Type)
+	}
+}
+
+func TestAddrUnix(t *testing.T) {
+	wire := []byte{AddrUnix, 9, '/', 't', 'm', 'p', '/', 's', 'o', 'c', 'k', 0, 0}
+
+	if _, err := NewRequest(CmdConnect, &Addr{Type: AddrUnix, Host: "/tmp/sock"}).MarshalBinary(); err != ErrBadAddrType {
+		t.Errorf("encode, disabled: %v, want %v", err, ErrBadAddrType)
+	}
+	if err := new(Addr).UnmarshalBinary(wire); err != ErrBadAddrType {
+		t.Errorf("decode, disabled: %v, want %v", err, ErrBadAddrType)
+	}
+
+	EnableUnixAddr = true
+	defer func() { EnableUnixAddr = false }()
+
+	addr, err := NewAddrFromNetAddr(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := addr.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, wire) {
+		t.Errorf("encoded % x, want % x", b, wire)
+	}
+
+	got := new(Addr)
+	if err := got.UnmarshalBinary(wire); err != nil {
+		t.Fatal(err)
+	}
+	if *got != *addr || got.String() != "/tmp/sock" {
+		t.Errorf("decoded %+v, want %+v", got, addr)
+	}
+	ua, err := got.UnixAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ua.Name != "/tmp/sock" || ua.Net != "unix" {
+		t.Errorf("UnixAddr() = %v", ua)
+	}
+}
+
+func TestRegisterAddrType(t *testing.T) {
+	// a token address: a length byte followed by the token
+	const addrToken = 0xF0
+	RegisterAddrType(addrToken,
+		func(b []byte) (string, int, error) {
+			if len(b) < 1 || len(b) < 1+int(b[0]) {
+				return "", 0, ErrShortBuffer
+			}
+			return string(b[1 : 1+b[0]]), 1 + int(b[0]), nil
+		},
+		func(host string, b []byte) (int, error) {
+			if len(host) > 255 {
+				return 0, ErrBadFormat
+			}
+			b[0] = byte(len(host))
+			return 1 + copy(b[1:], host), nil
+		})
+
+	want := &Addr{Type: addrToken, Host: "secret", Port: 443}
+	b, err := NewRequest(CmdConnect, want).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wire := []byte{Ver5, CmdConnect, 0, addrToken, 6, 's', 'e', 'c', 'r', 'e', 't', 1, 187}; !bytes.Equal(b, wire) {
+		t.Errorf("encoded % x, want % x", b, wire)
+	}
+
+	// a trailing byte shows that exactly one frame is read
+	r := bufio.NewReader(bytes.NewReader(append(b, 0xAA)))
+	req, err := ReadRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *req.Addr != *want {
+		t.Errorf("decoded %+v, want %+v", req.Addr, want)
+	}
+	if r.Buffered() != 1 {
+		t.Errorf("%d bytes left unread, want 1", r.Buffered())
+	}
+
+	if _, err := ReadRequest(bytes.NewReader(b[:8])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated: %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestAddrEqual(t *testing.T) {
+	v4 := &Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 80}
+	tests := []struct {
+		a, b *Addr
+		want bool
+	}{
+		{nil, nil, true},
+		{nil, v4, false},
+		{v4, nil, false},
+		{v4, &Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 80}, true},
+		{v4, &Addr{Type: AddrIPv6, Host: "::ffff:192.0.2.1", Port: 80}, true},
+		{v4, &Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 81}, false},
+		{v4, &Addr{Type: AddrIPv4, Host: "192.0.2.2", Port: 80}, false},
+		{v4, &Addr{Type: AddrDomain, Host: "example.com", Port: 80}, false},
+		{&Addr{Type: AddrDomain, Host: "Example.COM", Port: 80}, &Addr{Type: AddrDomain, Host: "example.com", Port: 80}, true},
+		{&Addr{Type: AddrDomain, Host: "example.com", Port: 80}, &Addr{Type: AddrDomain, Host: "example.com", Port: 443}, false},
+		{&Addr{Type: AddrIPv6, Host: "fe80::1", Zone: "eth0"}, &Addr{Type: AddrIPv6, Host: "fe80::1", Zone: "eth0"}, true},
+		{&Addr{Type: AddrIPv6, Host: "fe80::1", Zone: "eth0"}, &Addr{Type: AddrIPv6, Host: "fe80::1", Zone: "eth1"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Equal(tt.b); got != tt.want {
+			t.Errorf("%v.Equal(%v) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestAddrASCII(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"bücher.example:80", "xn--bcher-kva.example"},
+		{"example.com:80", "example.com"},
+		{"192.0.2.1:80", "192.0.2.1"},
+		{"[2001:db8::1]:80", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		addr, err := ParseAddr(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := addr.ASCII(); err != nil || got != tt.want {
+			t.Errorf("%s: ASCII() = %q, %v, want %q", tt.addr, got, err, tt.want)
+		}
+
+		addr, err = ParseAddrASCII(tt.addr)
+		if err != nil {
+			t.Errorf("ParseAddrASCII(%q): %v", tt.addr, err)
+			continue
+		}
+		if addr.Host != tt.want || addr.Port != 80 {
+			t.Errorf("ParseAddrASCII(%q) = %v, want host %q", tt.addr, addr, tt.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package gosocks5
+
+import (
+	"net"
+)
+
+// Authenticator decides how clients are authenticated: which of the methods
+// a client offers is selected, and how its sub-negotiation is run.
+type Authenticator interface {
+	// SelectMethod returns one of methods, or MethodNoAcceptable.
+	SelectMethod(methods ...uint8) uint8
+	// Authenticate runs the sub-negotiation of method on conn and returns
+	// the connection to carry on with.
+	Authenticate(method uint8, conn net.Conn) (net.Conn, error)
+}
+
+// IdentityAuthenticator is an Authenticator that also tells who the client
+// authenticated as, for the server to log and its handlers to go by; see
+// Conn.Identity.
+type IdentityAuthenticator interface {
+	Authenticator
+	// AuthenticateIdentity is Authenticate, also returning the identity.
+	AuthenticateIdentity(method uint8, conn net.Conn) (net.Conn, string, error)
+}
+
+// authConfig returns the Config of a server Conn authenticating with auth,
+// or nil for no authentication.
+func authConfig(auth Authenticator) *Config {
+	if auth == nil {
+		return nil
+	}
+	config := &Config{
+		SelectMethod:   auth.SelectMethod,
+		MethodSelected: auth.Authenticate,
+	}
+	if ia, ok := auth.(IdentityAuthenticator); ok {
+		config.Authenticate = ia.AuthenticateIdentity
+	}
+	return config
+}
+
+// UserPassAuthenticator requires RFC 1929 username/password authentication,
+// with the credentials checked by Verify.
+type UserPassAuthenticator struct {
+	Verify func(username, password string) bool
+}
+
+func (a *UserPassAuthenticator) SelectMethod(methods ...uint8) uint8 {
+	for _, method := range methods {
+		if method == MethodUserPass {
+			return MethodUserPass
+		}
+	}
+	return MethodNoAcceptable
+}
+
+func (a *UserPassAuthenticator) Authenticate(method uint8, conn net.Conn) (net.Conn, error) {
+	c, _, err := a.AuthenticateIdentity(method, conn)
+	return c, err
+}
+
+// AuthenticateIdentity is Authenticate, returning the username as well.
+func (a *UserPassAuthenticator) AuthenticateIdentity(method uint8, conn net.Conn) (net.Conn, string, error) {
+	if method != MethodUserPass {
+		return nil, "", ErrBadMethod
+	}
+
+	req, err := ReadUserPassRequest(conn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ok := a.Verify != nil && a.Verify(req.Username, req.Password)
+	status := AuthSuccess
+	if !ok {
+		status = AuthFailure
+	}
+	if err := NewUserPassResponse(UserPassVer, status).Write(conn); err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", ErrAuthFailure
+	}
+	return conn, req.Username, nil
+}
@@ -0,0 +1,99 @@
+package gosocks5
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+)
+
+// BufferedConn is a net.Conn whose reads go through a bufio.Reader. The Read
+// functions consume exactly one frame from a BufferedConn (or a bare
+// *bufio.Reader), so application data following the handshake can be read
+// from it without loss; from other readers they may read past the frame.
+type BufferedConn struct {
+	*bufio.Reader
+	net.Conn
+}
+
+func NewBufferedConn(conn net.Conn) *BufferedConn {
+	return &BufferedConn{
+		Reader: bufio.NewReader(conn),
+		Conn:   conn,
+	}
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if it
+// supports half-close, so that a relay through a BufferedConn still can.
+func (c *BufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// readFrame reads a frame from r into b and returns its length. frameLen
+// reports, given the bytes read so far, how long the frame is known to be;
+// reading stops once that many bytes are present. Buffered readers are
+// read exactly, others with reads that may go past the end of the frame.
+// io.EOF is returned only if r ends before the first byte. On error, the
+// number of bytes read into b so far is returned.
+func readFrame(r io.Reader, b []byte, frameLen func(b []byte) (int, error)) (int, error) {
+	if br, ok := bufferedReader(r); ok {
+		return readFrameFrom(br, b, frameLen, true)
+	}
+	return readFrameFrom(r, b, frameLen, false)
+}
+
+// readExactFrame is readFrame reading exactly from any reader, for frames a
+// peer may pipeline others behind, at the cost of more reads from an
+// unbuffered one.
+func readExactFrame(r io.Reader, b []byte, frameLen func(b []byte) (int, error)) (int, error) {
+	if br, ok := bufferedReader(r); ok {
+		r = br
+	}
+	return readFrameFrom(r, b, frameLen, true)
+}
+
+func readFrameFrom(r io.Reader, b []byte, frameLen func(b []byte) (int, error), exact bool) (int, error) {
+	n := 0
+	for {
+		length, err := frameLen(b[:n])
+		if err != nil {
+			return n, err
+		}
+		if n >= length {
+			return length, nil
+		}
+
+		var m int
+		if exact {
+			m, err = io.ReadFull(r, b[n:length])
+		} else {
+			m, err = io.ReadAtLeast(r, b[n:], length-n)
+		}
+		n += m
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func bufferedReader(r io.Reader) (*bufio.Reader, bool) {
+	switch r := r.(type) {
+	case *bufio.Reader:
+		return r, true
+	case *BufferedConn:
+		return r.Reader, true
+	case *coalescingConn:
+		return r.Reader, true
+	}
+	return nil, false
+}
@@ -0,0 +1,121 @@
+package gosocks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadExactFromBufferedReader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	NewUserPassRequest(UserPassVer, "user", "pass").Write(buf)
+	NewRequest(CmdConnect, &Addr{Type: AddrDomain, Host: "example.com", Port: 80}).Write(buf)
+	NewReply(Succeeded, &Addr{Type: AddrIPv6, Host: "::1", Port: 1080}).Write(buf)
+	buf.WriteString("payload")
+
+	r := bufio.NewReader(buf)
+	if _, err := ReadUserPassRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadReply(r); err != nil {
+		t.Fatal(err)
+	}
+
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "payload" {
+		t.Errorf("remaining data = %q, want %q", rest, "payload")
+	}
+}
+
+func TestBufferedConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		b, _ := NewRequest(CmdConnect, &Addr{Type: AddrIPv4, Host: "127.0.0.1", Port: 80}).MarshalBinary()
+		server.Write(append(b, "payload"...))
+	}()
+
+	conn := NewBufferedConn(client)
+	req, err := ReadRequest(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Addr.String() != "127.0.0.1:80" {
+		t.Errorf("addr = %s, want 127.0.0.1:80", req.Addr)
+	}
+
+	rest, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "payload" {
+		t.Errorf("remaining data = %q, want %q", rest, "payload")
+	}
+}
+
+func TestBufferedConnCloseWrite(t *testing.T) {
+	c, s := tcpPair(t)
+	if err := NewBufferedConn(c).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite over TCP: %v", err)
+	}
+	if b, err := io.ReadAll(s); err != nil || len(b) != 0 {
+		t.Errorf("peer read %q, %v, want EOF", b, err)
+	}
+	// the read side is still open
+	if _, err := s.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+		t.Errorf("read after CloseWrite: %v", err)
+	}
+
+	p, _ := net.Pipe()
+	defer p.Close()
+	if err := NewBufferedConn(p).CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("CloseWrite over a pipe: %v, want %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestClientConnCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// a target answering once the client is done sending
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+		c.Write([]byte("done"))
+	}()
+	addr := startServer(t, &Server{})
+
+	conn, err := (&Client{Addr: addr.String()}).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.(*Conn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if b, err := io.ReadAll(conn); err != nil || string(b) != "done" {
+		t.Errorf("read %q, %v, want %q", b, err, "done")
+	}
+}
@@ -0,0 +1,373 @@
+package gosocks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrBadScheme is returned by NewClientFromURL for a URL that is not of a
+// SOCKS5 proxy.
+var ErrBadScheme = errors.New("Bad scheme")
+
+// ResolveMode selects where a Client resolves domain name targets.
+type ResolveMode int
+
+const (
+	// RemoteResolve sends the domain name to the server to resolve.
+	RemoteResolve ResolveMode = iota
+	// LocalResolve resolves the name locally and sends the server an IP,
+	// e.g. for split-horizon DNS or to keep the name from the server.
+	LocalResolve
+)
+
+// AddrFamily selects which of the IPs a domain name resolves to a Client
+// uses under LocalResolve.
+type AddrFamily int
+
+const (
+	// AnyFamily takes the first IP, in the order the resolver returns them.
+	AnyFamily AddrFamily = iota
+	PreferIPv4
+	PreferIPv6
+	IPv4Only
+	IPv6Only
+)
+
+// Client dials connections through a SOCKS5 server. Each Dial makes its own
+// connection and state, so a Client may be used by multiple goroutines at
+// once, as long as its fields are not changed meanwhile.
+type Client struct {
+	Addr        string // address of the SOCKS5 server
+	Username    string // enables username/password authentication if set
+	Password    string
+	ResolveMode ResolveMode
+	AddrFamily  AddrFamily // which resolved IP to use under LocalResolve
+
+	// Methods, if set, is the list of methods offered to the server, in
+	// order of preference, instead of MethodNoAuth plus MethodUserPass when
+	// credentials are set. Only those two methods are supported.
+	Methods []uint8
+
+	// NoAuthOnly offers the server MethodNoAuth alone, whatever Methods and
+	// the credentials say, for servers that misbehave when offered more. A
+	// server selecting any other method fails the handshake with
+	// ErrBadMethod, so no authentication is ever attempted.
+	NoAuthOnly bool
+
+	// LenientReplies accepts replies with a missing BND.ADDR, or ATYP 0,
+	// from servers that cut corners; see DecodeOptions.LenientReplyAddr.
+	LenientReplies bool
+
+	// FastOpen sends the method selection along with the SYN to the server
+	// using TCP Fast Open, saving a round trip, where the platform supports
+	// it (Linux). Elsewhere it has no effect.
+	FastOpen bool
+
+	// KeepAlive is the TCP keep-alive period of the connection to the server,
+	// which keeps long idle tunnels and UDP ASSOCIATE control connections
+	// from being dropped by NATs and firewalls. Keep-alives are on by
+	// default, with the period of net.Dialer; a negative KeepAlive disables
+	// them.
+	KeepAlive time.Duration
+
+	// HandshakeTimeout, if positive, bounds the time a Dial takes from
+	// connecting to the server to receiving the reply to its request, after
+	// which it fails with ErrTimeout. The connection returned has no
+	// deadline.
+	HandshakeTimeout time.Duration
+
+	// TLSConfig, if set, makes the connection to the server TLS, with the
+	// SOCKS5 handshake run inside it, as for a server behind stunnel or one
+	// with Server.TLSConfig set. The ServerName defaults to the host of Addr.
+	TLSConfig *tls.Config
+
+	// DialServer, if set, makes the connection to the server in place of a
+	// net.Dialer, e.g. to reach it through another proxy or an in-memory
+	// pipe in tests. FastOpen and KeepAlive are then up to DialServer.
+	DialServer func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewClientFromURL returns a Client for the proxy at u, of the form
+// socks5://[user:pass@]host:port; the scheme socks5h is accepted as well.
+// Either way, names are resolved by the server, as with RemoteResolve.
+//
+// With its Dial and DialContext methods, a Client is a proxy.Dialer and a
+// proxy.ContextDialer of golang.org/x/net/proxy, and can stand in for the
+// SOCKS5 dialer of that package:
+//
+//	proxy.RegisterDialerType("socks5", func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+//		c, err := gosocks5.NewClientFromURL(u)
+//		if err != nil {
+//			return nil, err
+//		}
+//		c.DialServer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+//			return forward.Dial(network, addr)
+//		}
+//		return c, nil
+//	})
+func NewClientFromURL(u *url.URL) (*Client, error) {
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, ErrBadScheme
+	}
+	c := &Client{Addr: u.Host}
+	if u.User != nil {
+		c.Username = u.User.Username()
+		c.Password, _ = u.User.Password()
+	}
+	return c, nil
+}
+
+// ReplyError is returned when a server answers a request with a reply code
+// other than Succeeded.
+type ReplyError struct {
+	Rep uint8
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("Request failed, reply %d", e.Rep)
+}
+
+// Dial connects to addr through the SOCKS5 server. network is used to reach
+// the server and must be "tcp", "tcp4" or "tcp6". The connection returned
+// is a *Conn, whose Method tells how the server had the client authenticate.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial, but gives up once ctx is done, whether in
+// connecting to the server, resolving addr under LocalResolve or in the
+// handshake, and then returns ctx.Err(). Once the connection is returned,
+// ctx no longer applies to it.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	dial := c.DialServer
+	if dial == nil {
+		dial = c.dialer().DialContext
+	}
+	conn, err := dial(ctx, network, c.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.HandshakeTimeout))
+	}
+	// unblock the handshake once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	cc, err := c.startTLS(ctx, conn)
+	if err == nil {
+		cc, err = c.connect(ctx, cc, addr)
+	}
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, timeoutErr(err)
+	}
+	if c.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	return cc, nil
+}
+
+// startTLS runs the TLS handshake on conn under TLSConfig, if set.
+func (c *Client) startTLS(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if c.TLSConfig == nil {
+		return conn, nil
+	}
+	config := c.TLSConfig
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = c.Addr
+		if host, _, err := net.SplitHostPort(c.Addr); err == nil {
+			config.ServerName = host
+		}
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+func (c *Client) dialer() *net.Dialer {
+	dialer := &net.Dialer{KeepAlive: c.KeepAlive}
+	if c.FastOpen {
+		dialer.Control = fastOpenControl
+	}
+	return dialer
+}
+
+// Handshake negotiates a method with the server on conn and authenticates,
+// and returns the Conn once the server is ready for a request; its Method is
+// the one the server selected. It reads nothing past the server's answers, so
+// the caller can go on to write Requests and read Replies on the Conn or on
+// conn itself, e.g. for a BIND or a UDP ASSOCIATE, which Dial does not cover.
+func (c *Client) Handshake(conn net.Conn) (*Conn, error) {
+	cc := ClientConn(conn, c.config())
+	if err := cc.Handleshake(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// connect negotiates with the server on conn and issues a CONNECT to addr.
+func (c *Client) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	target, err := c.targetAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the reply exactly, so that target data arriving with it stays
+	// buffered for the caller
+	bc := NewBufferedConn(conn)
+	cc := ClientConn(bc, c.config())
+	if err := cc.Handleshake(); err != nil {
+		return nil, err
+	}
+
+	if err := NewRequest(CmdConnect, target).Write(cc); err != nil {
+		return nil, err
+	}
+	rep, err := ReadReplyWithOptions(bc, &DecodeOptions{LenientReplyAddr: c.LenientReplies})
+	if err != nil {
+		return nil, err
+	}
+	if rep.Rep != Succeeded {
+		return nil, &ReplyError{Rep: rep.Rep}
+	}
+
+	return cc, nil
+}
+
+// targetAddr parses addr, resolving a domain name first under LocalResolve.
+func (c *Client) targetAddr(ctx context.Context, addr string) (*Addr, error) {
+	target, err := ParseAddr(addr)
+	if err != nil || target.Type != AddrDomain || c.ResolveMode != LocalResolve {
+		return target, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, target.Host)
+	if err != nil {
+		return nil, err
+	}
+	ip, ok := pickIP(ips, c.AddrFamily)
+	if !ok {
+		return nil, &net.DNSError{Err: "no address of the required family", Name: target.Host, IsNotFound: true}
+	}
+	return ipAddr(ip.IP, int(target.Port), ip.Zone), nil
+}
+
+// pickIP chooses one of ips according to family.
+func pickIP(ips []net.IPAddr, family AddrFamily) (net.IPAddr, bool) {
+	want4 := family == PreferIPv4 || family == IPv4Only
+	for _, ip := range ips {
+		if family == AnyFamily || (ip.IP.To4() != nil) == want4 {
+			return ip, true
+		}
+	}
+	if (family == PreferIPv4 || family == PreferIPv6) && len(ips) > 0 {
+		return ips[0], true
+	}
+	return net.IPAddr{}, false
+}
+
+func (c *Client) config() *Config {
+	config := &Config{
+		Methods:        c.Methods,
+		MethodSelected: c.methodSelected,
+	}
+	if c.NoAuthOnly {
+		config.Methods = []uint8{MethodNoAuth}
+	} else if len(config.Methods) == 0 {
+		config.Methods = []uint8{MethodNoAuth}
+		if c.Username != "" || c.Password != "" {
+			config.Methods = append(config.Methods, MethodUserPass)
+		}
+	}
+	return config
+}
+
+func (c *Client) methodSelected(method uint8, conn net.Conn) (net.Conn, error) {
+	switch method {
+	case MethodNoAuth:
+	case MethodUserPass:
+		req := NewUserPassRequest(UserPassVer, c.Username, c.Password)
+		if err := req.Write(conn); err != nil {
+			return nil, err
+		}
+		res, err := ReadUserPassResponse(conn)
+		if err != nil {
+			return nil, err
+		}
+		if !res.OK() {
+			return nil, ErrAuthFailure
+		}
+	default:
+		return nil, ErrBadMethod
+	}
+	return conn, nil
+}
+
+// DialChain connects to target through each of proxies in turn. Every entry
+// is a SOCKS5 server address in the form "[user:pass@]host:port"; the first
+// is reached over network, and each following hop and finally target are
+// reached by a CONNECT through the tunnel built so far.
+func DialChain(proxies []string, target string, network string) (net.Conn, error) {
+	if len(proxies) == 0 {
+		return net.Dial(network, target)
+	}
+
+	hops := make([]*Client, len(proxies))
+	for i, proxy := range proxies {
+		hops[i] = parseProxy(proxy)
+	}
+
+	conn, err := hops[0].Dial(network, hopAddr(hops, 1, target))
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(hops); i++ {
+		cc, err := hops[i].connect(context.Background(), conn, hopAddr(hops, i+1, target))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = cc
+	}
+
+	return conn, nil
+}
+
+func hopAddr(hops []*Client, i int, target string) string {
+	if i < len(hops) {
+		return hops[i].Addr
+	}
+	return target
+}
+
+func parseProxy(s string) *Client {
+	c := &Client{Addr: s}
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		c.Addr = s[i+1:]
+		c.Username, c.Password, _ = strings.Cut(s[:i], ":")
+	}
+	return c
+}
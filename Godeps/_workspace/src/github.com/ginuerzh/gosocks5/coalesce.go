@@ -0,0 +1,64 @@
+package gosocks5
+
+import (
+	"bufio"
+	"net"
+)
+
+// coalescingConn buffers writes until a read would block waiting for the
+// peer, so the answers to a client that pipelined its handshake go out in
+// a single write. stop flushes the buffer and makes later writes direct.
+type coalescingConn struct {
+	*BufferedConn
+	w *bufio.Writer
+}
+
+func newCoalescingConn(conn net.Conn) *coalescingConn {
+	c := &coalescingConn{w: bufio.NewWriter(conn)}
+	// bufio only reads from flushReader once its buffer is empty, which is
+	// exactly when whatever is pending has to go out.
+	c.BufferedConn = &BufferedConn{
+		Reader: bufio.NewReader(flushReader{c}),
+		Conn:   conn,
+	}
+	return c
+}
+
+func (c *coalescingConn) Write(b []byte) (int, error) {
+	if c.w == nil {
+		return c.Conn.Write(b)
+	}
+	return c.w.Write(b)
+}
+
+// CloseWrite sends what is held back before shutting down the writing side.
+func (c *coalescingConn) CloseWrite() error {
+	if err := c.stop(); err != nil {
+		return err
+	}
+	return c.BufferedConn.CloseWrite()
+}
+
+func (c *coalescingConn) flush() error {
+	if c.w == nil {
+		return nil
+	}
+	return c.w.Flush()
+}
+
+func (c *coalescingConn) stop() error {
+	err := c.flush()
+	c.w = nil
+	return err
+}
+
+type flushReader struct {
+	c *coalescingConn
+}
+
+func (r flushReader) Read(b []byte) (int, error) {
+	if err := r.c.flush(); err != nil {
+		return 0, err
+	}
+	return r.c.Conn.Read(b)
+}
@@ -0,0 +1,116 @@
+package gosocks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ginuerzh/gosocks5/gosocks5test"
+)
+
+// pipelinedConn plays a client that sent its whole handshake at once, and
+// counts the writes made to it.
+type pipelinedConn struct {
+	net.Conn
+	r      io.Reader
+	writes int
+}
+
+func (c *pipelinedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *pipelinedConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+func (c *pipelinedConn) Close() error {
+	return nil
+}
+
+var userPassConfig = Config{
+	SelectMethod: func(methods ...uint8) uint8 {
+		return MethodUserPass
+	},
+	MethodSelected: func(method uint8, conn net.Conn) (net.Conn, error) {
+		if _, err := ReadUserPassRequest(conn); err != nil {
+			return nil, err
+		}
+		return conn, NewUserPassResponse(UserPassVer, AuthSuccess).Write(conn)
+	},
+}
+
+// serveHandshake runs the server side of a handshake with userpass
+// authentication on c and returns the number of writes it took.
+func serveHandshake(tb testing.TB, handshake []byte, coalesce bool) int {
+	config := userPassConfig
+	config.CoalesceWrites = coalesce
+
+	c := &pipelinedConn{r: bytes.NewReader(handshake)}
+	var conn *Conn
+	if coalesce {
+		conn = ServerConn(c, &config)
+	} else {
+		// buffered, so the pipelined frames are read exactly
+		conn = ServerConn(NewBufferedConn(c), &config)
+	}
+	if err := conn.Handleshake(); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := conn.ReadRequest(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := conn.WriteReply(NewReply(Succeeded, nil)); err != nil {
+		tb.Fatal(err)
+	}
+	return c.writes
+}
+
+func pipelinedHandshake() []byte {
+	return bytes.Join([][]byte{
+		{Ver5, 1, MethodUserPass},
+		gosocks5test.UserPassRequest(),
+		gosocks5test.RequestIPv4(),
+	}, nil)
+}
+
+func BenchmarkServerHandshake(b *testing.B) {
+	handshake := pipelinedHandshake()
+	for _, coalesce := range []bool{false, true} {
+		name := "direct"
+		if coalesce {
+			name = "coalesced"
+		}
+		b.Run(name, func(b *testing.B) {
+			writes := 0
+			for i := 0; i < b.N; i++ {
+				writes += serveHandshake(b, handshake, coalesce)
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestCoalesceWrites(t *testing.T) {
+	if n := serveHandshake(t, pipelinedHandshake(), true); n != 1 {
+		t.Errorf("pipelined handshake took %d writes, want 1", n)
+	}
+
+	// a client waiting for each answer must still get it
+	config := userPassConfig
+	config.CoalesceWrites = true
+	addr := startServer(t, &Server{
+		Config: &config,
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			return w.Reply(Succeeded, nil)
+		},
+	})
+	client := &Client{Addr: addr.String(), Methods: []uint8{MethodUserPass}}
+	conn, err := client.Dial("tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
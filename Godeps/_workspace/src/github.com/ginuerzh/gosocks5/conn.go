@@ -1,7 +1,8 @@
 package gosocks5
 
 import (
-	"io"
+	"bytes"
+	"errors"
 	//"log"
 	"net"
 	"sync"
@@ -12,18 +13,56 @@ type Config struct {
 	Methods        []uint8
 	SelectMethod   func(methods ...uint8) uint8
 	MethodSelected func(method uint8, conn net.Conn) (net.Conn, error)
+	Hooks          *Hooks
+
+	// Authenticate, if set, runs the sub-negotiation in place of
+	// MethodSelected and also returns the identity the client authenticated
+	// as, e.g. its username, which a server Conn reports with Identity.
+	Authenticate func(method uint8, conn net.Conn) (net.Conn, string, error)
+
+	// EncodeOptions, if set, applies to the replies a server Conn writes.
+	EncodeOptions *EncodeOptions
+
+	// DecodeOptions, if set, applies to the request a server Conn reads,
+	// e.g. to accept broken clients with QuirkMode, and to the datagrams
+	// the UDP relay of a Server receives from the client.
+	DecodeOptions *DecodeOptions
+
+	// CoalesceWrites makes a server Conn hold back its handshake writes
+	// until it has to wait for the client, so that a client pipelining its
+	// handshake gets the method selection, the sub-negotiation answer and
+	// the reply in one write. Writing the reply, or any data through the
+	// Conn, flushes and ends the coalescing.
+	CoalesceWrites bool
 }
 
 func defaultConfig() *Config {
 	return &Config{}
 }
 
+// connState tracks how far a Conn has progressed through the protocol.
+type connState uint8
+
+const (
+	stateNew connState = iota
+	stateNegotiated
+	stateAuthenticated
+	stateRequested
+	stateReplied
+)
+
 type Conn struct {
 	c              net.Conn
 	config         *Config
 	method         uint8
+	identity       string // as returned by Config.Authenticate
 	isClient       bool
-	handshaked     bool
+	state          connState
+	bindPending    bool // a successful BIND is owed its second reply
+	req            *Request
+	rep            uint8     // code of the last reply written
+	deadline       time.Time // handshake deadline, cleared by the first reply
+	coalescer      *coalescingConn
 	handshakeMutex sync.Mutex
 	handshakeErr   error
 }
@@ -36,13 +75,26 @@ func ClientConn(conn net.Conn, config *Config) *Conn {
 	}
 }
 
+// ServerConn returns the server side of a SOCKS5 connection on conn. It
+// reads conn through a BufferedConn, unless conn is one already, so that the
+// frames are read exactly and data the client pipelines behind its request
+// is still there to be read from the Conn.
 func ServerConn(conn net.Conn, config *Config) *Conn {
-	return &Conn{
+	c := &Conn{
 		c:      conn,
 		config: config,
 	}
+	if config != nil && config.CoalesceWrites {
+		c.coalescer = newCoalescingConn(conn)
+		c.c = c.coalescer
+	} else if _, ok := conn.(*BufferedConn); !ok {
+		c.c = NewBufferedConn(conn)
+	}
+	return c
 }
 
+// Handleshake runs whatever remains of the method negotiation and
+// authentication. It is called implicitly by Read and Write.
 func (conn *Conn) Handleshake() error {
 	conn.handshakeMutex.Lock()
 	defer conn.handshakeMutex.Unlock()
@@ -50,91 +102,267 @@ func (conn *Conn) Handleshake() error {
 	if err := conn.handshakeErr; err != nil {
 		return err
 	}
-	if conn.handshaked {
+	if conn.state >= stateAuthenticated {
 		return nil
 	}
 
-	if conn.isClient {
-		conn.handshakeErr = conn.clientHandshake()
-	} else {
-		conn.handshakeErr = conn.serverHandshake()
+	if conn.state == stateNew {
+		if conn.handshakeErr = conn.negotiate(); conn.handshakeErr != nil {
+			return conn.handshakeErr
+		}
 	}
+	conn.handshakeErr = conn.authenticate()
 
 	return conn.handshakeErr
 }
 
-func (conn *Conn) clientHandshake() error {
-	if conn.config == nil {
-		conn.config = defaultConfig()
+// Negotiate performs the method selection. It must be the first step on a
+// new Conn and be followed by Authenticate.
+func (conn *Conn) Negotiate() error {
+	conn.handshakeMutex.Lock()
+	defer conn.handshakeMutex.Unlock()
+
+	if conn.state != stateNew {
+		return ErrBadState
 	}
+	conn.handshakeErr = conn.negotiate()
+	return conn.handshakeErr
+}
+
+// Authenticate runs the sub-negotiation of the selected method, if any.
+func (conn *Conn) Authenticate() error {
+	conn.handshakeMutex.Lock()
+	defer conn.handshakeMutex.Unlock()
 
-	nm := len(conn.config.Methods)
-	if nm == 0 {
-		nm = 1
+	if conn.state != stateNegotiated {
+		return ErrBadState
 	}
+	conn.handshakeErr = conn.authenticate()
+	return conn.handshakeErr
+}
 
-	b := make([]byte, 2+nm)
-	b[0] = Ver5
-	b[1] = uint8(nm)
-	copy(b[2:], conn.config.Methods)
+// ReadRequest reads the client's request on an authenticated server Conn.
+func (conn *Conn) ReadRequest() (*Request, error) {
+	if conn.isClient || conn.state != stateAuthenticated {
+		return nil, ErrBadState
+	}
 
-	if _, err := conn.c.Write(b); err != nil {
-		return err
+	req, err := ReadRequestWithOptions(conn.c, conn.decodeOptions())
+	if err != nil {
+		conn.hooks().onError(err)
+		return nil, err
 	}
+	conn.hooks().onRequest(req)
+	conn.req = req
+	conn.state = stateRequested
+	conn.bindPending = req.Cmd == CmdBind
 
-	if _, err := io.ReadFull(conn.c, b[:2]); err != nil {
-		return err
+	return req, nil
+}
+
+// Method returns the method the server selected, on a client Conn as on a
+// server one, or MethodNoAcceptable before the selection is done.
+func (conn *Conn) Method() uint8 {
+	if conn.state < stateNegotiated {
+		return MethodNoAcceptable
 	}
+	return conn.method
+}
 
-	if b[0] != Ver5 {
-		return ErrBadVersion
+// Identity returns who the client authenticated as on a server Conn, as
+// Config.Authenticate told, e.g. the username under UserPassAuthenticator.
+// It is empty for MethodNoAuth, or when the method does not tell.
+func (conn *Conn) Identity() string {
+	return conn.identity
+}
+
+// Request returns the request read by ReadRequest, or nil.
+func (conn *Conn) Request() *Request {
+	return conn.req
+}
+
+// WriteReply answers the request read by ReadRequest. Only a successful
+// BIND may be answered twice, the second reply announcing the peer.
+func (conn *Conn) WriteReply(rep *Reply) error {
+	switch {
+	case conn.isClient:
+		return ErrBadState
+	case conn.state == stateRequested:
+		conn.bindPending = conn.bindPending && rep.Rep == Succeeded
+	case conn.state == stateReplied && conn.bindPending:
+		conn.bindPending = false
+	default:
+		return ErrBadState
 	}
+	return conn.writeReply(rep)
+}
 
-	if conn.config.MethodSelected != nil {
-		c, err := conn.config.MethodSelected(b[1], conn.c)
-		if err != nil {
-			return err
-		}
-		conn.c = c
+func (conn *Conn) writeReply(rep *Reply) error {
+	err := rep.WriteWithOptions(conn.c, conn.encodeOptions())
+	if err == nil {
+		err = conn.stopCoalescing()
+	}
+	if err != nil {
+		conn.hooks().onError(err)
+		return err
+	}
+	conn.hooks().onReply(rep)
+	conn.rep = rep.Rep
+	conn.state = stateReplied
+	if !conn.deadline.IsZero() {
+		conn.deadline = time.Time{}
+		conn.c.SetDeadline(time.Time{})
 	}
-	conn.method = b[1]
-	//log.Println("method:", conn.method)
-	conn.handshaked = true
 	return nil
 }
 
-func (conn *Conn) serverHandshake() error {
+// Reply writes a reply with code rep and address addr, as WriteReply does.
+func (conn *Conn) Reply(rep uint8, addr *Addr) error {
+	return conn.WriteReply(NewReply(rep, addr))
+}
+
+// CloseWithError closes a server Conn that failed to serve its request
+// because of err, first telling the client why with a reply whose code is
+// ReplyCodeForError(err), rather than leaving it with an abrupt close. The
+// reply is sent if the request has not been answered yet, including when
+// ReadRequest rejected it for its content, such as an unsupported address
+// type; it is left out when there is no request to answer.
+func (conn *Conn) CloseWithError(err error) error {
+	if !conn.isClient && err != nil && (conn.state == stateRequested || conn.state == stateAuthenticated && badRequest(err)) {
+		conn.writeReply(NewReplyFromError(err, nil))
+	}
+	return conn.Close()
+}
+
+// badRequest reports whether err rejects a request frame that was read in
+// full, as opposed to one that could not be read.
+func badRequest(err error) bool {
+	return errors.Is(err, ErrBadAddrType) || errors.Is(err, ErrBadFormat) || errors.Is(err, ErrBadVersion)
+}
+
+func (conn *Conn) replied() bool {
+	return conn.state == stateReplied
+}
+
+func (conn *Conn) negotiate() error {
 	if conn.config == nil {
 		conn.config = defaultConfig()
 	}
 
+	var err error
+	if conn.isClient {
+		err = conn.clientNegotiate()
+	} else {
+		err = conn.serverNegotiate()
+	}
+	if err != nil {
+		conn.hooks().onError(err)
+		return err
+	}
+	conn.state = stateNegotiated
+	return nil
+}
+
+func (conn *Conn) clientNegotiate() error {
+	b := EncodeHandshake(conn.config.Methods)
+	if _, err := conn.c.Write(b); err != nil {
+		return err
+	}
+
+	method, err := ReadMethodSelection(conn.c)
+	if err != nil {
+		return err
+	}
+	if bytes.IndexByte(b[2:], method) < 0 {
+		// the server may only pick one of the methods offered
+		return ErrBadMethod
+	}
+	conn.method = method
+	//log.Println("method:", conn.method)
+	return nil
+}
+
+func (conn *Conn) serverNegotiate() error {
 	methods, err := ReadMethods(conn.c)
 	if err != nil {
 		return err
 	}
 
-	method := MethodNoAuth
+	var method uint8
 	if conn.config.SelectMethod != nil {
 		method = conn.config.SelectMethod(methods...)
+	} else {
+		method = selectNoAuth(methods)
 	}
 
 	if _, err := conn.c.Write([]byte{Ver5, method}); err != nil {
 		return err
 	}
-
-	if conn.config.MethodSelected != nil {
-		c, err := conn.config.MethodSelected(method, conn.c)
-		if err != nil {
-			return err
-		}
-		conn.c = c
+	if method == MethodNoAcceptable {
+		// RFC 1928: the client must close the connection, but a server
+		// has nothing left to wait for either
+		conn.stopCoalescing()
+		conn.c.Close()
+		return ErrNoAcceptableMethod
 	}
 	conn.method = method
 	//log.Println("method:", method)
-	conn.handshaked = true
 	return nil
 }
 
+// selectNoAuth is the method selection without Config.SelectMethod, which
+// supports only MethodNoAuth.
+func selectNoAuth(methods []uint8) uint8 {
+	if bytes.IndexByte(methods, MethodNoAuth) >= 0 {
+		return MethodNoAuth
+	}
+	return MethodNoAcceptable
+}
+
+func (conn *Conn) authenticate() error {
+	c, identity, err := conn.config.authenticate(conn.method, conn.c)
+	if err != nil {
+		conn.hooks().onError(err)
+		return err
+	}
+	conn.c, conn.identity = c, identity
+	conn.state = stateAuthenticated
+	return nil
+}
+
+// authenticate runs Authenticate, or else MethodSelected, if any.
+func (config *Config) authenticate(method uint8, conn net.Conn) (net.Conn, string, error) {
+	if config.Authenticate != nil {
+		return config.Authenticate(method, conn)
+	}
+	if config.MethodSelected != nil {
+		c, err := config.MethodSelected(method, conn)
+		return c, "", err
+	}
+	return conn, "", nil
+}
+
+func (conn *Conn) encodeOptions() *EncodeOptions {
+	if conn.config == nil {
+		return nil
+	}
+	return conn.config.EncodeOptions
+}
+
+func (conn *Conn) decodeOptions() *DecodeOptions {
+	if conn.config == nil {
+		return nil
+	}
+	return conn.config.DecodeOptions
+}
+
+func (conn *Conn) hooks() *Hooks {
+	if conn.config == nil {
+		return nil
+	}
+	return conn.config.Hooks
+}
+
 func (conn *Conn) Read(b []byte) (n int, err error) {
 	if err = conn.Handleshake(); err != nil {
 		return
@@ -146,13 +374,76 @@ func (conn *Conn) Write(b []byte) (n int, err error) {
 	if err = conn.Handleshake(); err != nil {
 		return
 	}
-	return conn.c.Write(b)
+	if n, err = conn.c.Write(b); err != nil {
+		return
+	}
+	return n, conn.stopCoalescing()
+}
+
+// Detach hands over the connection for relaying once the handshake is done:
+// on a server Conn, once the request is answered for good; on a client Conn,
+// once authenticated. It flushes any handshake output still held back by
+// CoalesceWrites and returns the connection Conn was reading through,
+// unwrapped of the BufferedConn it may have been given or made, along with
+// the bytes already read from it but not consumed, such as data the peer
+// sent right behind its handshake. These come first in what the peer sent,
+// e.g. io.MultiReader(bytes.NewReader(buffered), c). A server Conn always
+// reads through a buffer, so nothing the client pipelined is lost; a client
+// Conn only buffers when given a BufferedConn, as Client.Dial does, and
+// otherwise reads nothing past the server's answers and returns no bytes.
+// The Conn must not be used afterwards, other than to be dropped.
+func (conn *Conn) Detach() (c net.Conn, buffered []byte, err error) {
+	conn.handshakeMutex.Lock()
+	defer conn.handshakeMutex.Unlock()
+
+	if conn.isClient && conn.state < stateAuthenticated ||
+		!conn.isClient && (conn.state != stateReplied || conn.bindPending) {
+		return nil, nil, ErrBadState
+	}
+	if err := conn.stopCoalescing(); err != nil {
+		return nil, nil, err
+	}
+
+	// a connection MethodSelected wrapped is handed over as it is
+	c = conn.c
+	var bc *BufferedConn
+	switch cc := c.(type) {
+	case *coalescingConn:
+		bc = cc.BufferedConn
+	case *BufferedConn:
+		bc = cc
+	}
+	if bc != nil {
+		c = bc.Conn
+		if n := bc.Reader.Buffered(); n > 0 {
+			buffered = make([]byte, n)
+			bc.Reader.Read(buffered)
+		}
+	}
+	return c, buffered, nil
+}
+
+func (conn *Conn) stopCoalescing() error {
+	if conn.coalescer == nil {
+		return nil
+	}
+	return conn.coalescer.stop()
 }
 
 func (conn *Conn) Close() error {
+	conn.stopCoalescing()
 	return conn.c.Close()
 }
 
+// CloseWrite shuts down the writing side of the underlying connection, if it
+// supports half-close.
+func (conn *Conn) CloseWrite() error {
+	if cw, ok := conn.c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
 func (conn *Conn) LocalAddr() net.Addr {
 	return conn.c.LocalAddr()
 }
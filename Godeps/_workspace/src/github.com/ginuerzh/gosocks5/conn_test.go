@@ -0,0 +1,238 @@
+package gosocks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ginuerzh/gosocks5/gosocks5test"
+)
+
+// pipeClient drives the client side of a handshake followed by a request
+// for cmd, then reads up to replies replies.
+func pipeClient(t *testing.T, c net.Conn, cmd uint8, replies int) chan error {
+	errc := make(chan error, 1)
+	go func() {
+		conn := ClientConn(c, nil)
+		if err := conn.Handleshake(); err != nil {
+			errc <- err
+			return
+		}
+		req := NewRequest(cmd, &Addr{Type: AddrIPv4, Host: "127.0.0.1", Port: 80})
+		if err := req.Write(conn); err != nil {
+			errc <- err
+			return
+		}
+		for i := 0; i < replies; i++ {
+			if _, err := ReadReply(conn); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	return errc
+}
+
+func TestConnStateOrder(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errc := pipeClient(t, client, CmdConnect, 1)
+	conn := ServerConn(server, nil)
+	rep := NewReply(Succeeded, nil)
+
+	if err := conn.WriteReply(rep); err != ErrBadState {
+		t.Fatalf("WriteReply before Negotiate: %v, want %v", err, ErrBadState)
+	}
+	if err := conn.Authenticate(); err != ErrBadState {
+		t.Fatalf("Authenticate before Negotiate: %v, want %v", err, ErrBadState)
+	}
+	if err := conn.Negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Negotiate(); err != ErrBadState {
+		t.Fatalf("second Negotiate: %v, want %v", err, ErrBadState)
+	}
+	if _, err := conn.ReadRequest(); err != ErrBadState {
+		t.Fatalf("ReadRequest before Authenticate: %v, want %v", err, ErrBadState)
+	}
+	if err := conn.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteReply(rep); err != ErrBadState {
+		t.Fatalf("WriteReply before ReadRequest: %v, want %v", err, ErrBadState)
+	}
+	req, err := conn.ReadRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Cmd != CmdConnect {
+		t.Errorf("Cmd = %d, want %d", req.Cmd, CmdConnect)
+	}
+	if _, err := conn.ReadRequest(); err != ErrBadState {
+		t.Fatalf("second ReadRequest: %v, want %v", err, ErrBadState)
+	}
+	if err := conn.WriteReply(rep); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteReply(rep); err != ErrBadState {
+		t.Fatalf("second WriteReply: %v, want %v", err, ErrBadState)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnBindTwoReplies(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errc := pipeClient(t, client, CmdBind, 2)
+	conn := ServerConn(server, nil)
+
+	if err := conn.Handleshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ReadRequest(); err != nil {
+		t.Fatal(err)
+	}
+	rep := NewReply(Succeeded, nil)
+	for i := 0; i < 2; i++ {
+		if err := conn.WriteReply(rep); err != nil {
+			t.Fatalf("reply %d: %v", i+1, err)
+		}
+	}
+	if err := conn.WriteReply(rep); err != ErrBadState {
+		t.Fatalf("third WriteReply: %v, want %v", err, ErrBadState)
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientNoAcceptableMethod(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		if _, err := ReadMethods(server); err == nil {
+			server.Write([]byte{Ver5, MethodNoAcceptable})
+		}
+	}()
+
+	err := ClientConn(client, &Config{Methods: []uint8{MethodUserPass}}).Handleshake()
+	if !errors.Is(err, ErrNoAcceptableMethod) {
+		t.Errorf("Handleshake: %v, want %v", err, ErrNoAcceptableMethod)
+	}
+}
+
+func TestServerNoAcceptableMethod(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ServerConn(server, nil).Handleshake()
+	}()
+
+	if _, err := client.Write([]byte{Ver5, 1, MethodGSSAPI}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{Ver5, MethodNoAcceptable}; !bytes.Equal(b, want) {
+		t.Errorf("server sent % x, want % x and close", b, want)
+	}
+	if err := <-errc; !errors.Is(err, ErrNoAcceptableMethod) {
+		t.Errorf("Handleshake: %v, want %v", err, ErrNoAcceptableMethod)
+	}
+}
+
+func TestClientUnofferedMethod(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		if _, err := ReadMethods(server); err == nil {
+			server.Write([]byte{Ver5, MethodUserPass})
+		}
+	}()
+
+	err := ClientConn(client, &Config{Methods: []uint8{MethodNoAuth}}).Handleshake()
+	if err != ErrBadMethod {
+		t.Errorf("Handleshake: %v, want %v", err, ErrBadMethod)
+	}
+}
+
+func TestConnDetach(t *testing.T) {
+	handshake := append(gosocks5test.Methods(), gosocks5test.RequestIPv4()...)
+	for _, mode := range []string{"plain", "buffered", "coalesce"} {
+		c, s := tcpPair(t)
+		var conn *Conn
+		switch mode {
+		case "plain":
+			// ServerConn buffers a plain conn itself
+			conn = ServerConn(s, nil)
+		case "buffered":
+			conn = ServerConn(NewBufferedConn(s), nil)
+		case "coalesce":
+			conn = ServerConn(s, &Config{CoalesceWrites: true})
+		}
+
+		// the client sends its first data along with the handshake
+		if _, err := c.Write(append(handshake, "early"...)); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Handleshake(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.ReadRequest(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.Detach(); err != ErrBadState {
+			t.Errorf("Detach before the reply: %v, want %v", err, ErrBadState)
+		}
+		if err := conn.Reply(Succeeded, nil); err != nil {
+			t.Fatal(err)
+		}
+		raw, buffered, err := conn.Detach()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw != s {
+			t.Errorf("%s: Detach returned %T, want the accepted conn", mode, raw)
+		}
+
+		b := make([]byte, len("early"))
+		if _, err := io.ReadFull(io.MultiReader(bytes.NewReader(buffered), raw), b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "early" {
+			t.Errorf("%s: client data %q, want %q", mode, b, "early")
+		}
+
+		// the answers, then what is written on the detached conn
+		if _, err := raw.Write([]byte("late")); err != nil {
+			t.Fatal(err)
+		}
+		want := []byte{Ver5, MethodNoAuth, Ver5, Succeeded, 0, AddrIPv4, 0, 0, 0, 0, 0, 0, 'l', 'a', 't', 'e'}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: client got % x, want % x", mode, got, want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package gosocks5
+
+import (
+	"io"
+)
+
+// Detect reads the first byte of r to tell which protocol its peer speaks,
+// and returns the SOCKS version, 5 or 4, or 0 if it is neither. The bytes
+// consumed are returned in peeked, so the stream can be handed on intact,
+// e.g. as io.MultiReader(bytes.NewReader(peeked), r).
+func Detect(r io.Reader) (version int, peeked []byte, err error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+
+	switch b[0] {
+	case Ver5, 4:
+		return int(b[0]), b, nil
+	}
+	return 0, b, nil
+}
@@ -0,0 +1,37 @@
+package gosocks5
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		b       []byte
+		version int
+	}{
+		{[]byte{Ver5, 1, MethodNoAuth}, 5},
+		{[]byte{4, CmdConnect, 0, 80, 192, 0, 2, 1, 0}, 4},
+		{[]byte("GET / HTTP/1.1\r\n"), 0},
+	}
+
+	for _, tt := range tests {
+		r := bytes.NewReader(tt.b)
+		version, peeked, err := Detect(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != tt.version {
+			t.Errorf("Detect(%q) = %d, want %d", tt.b, version, tt.version)
+		}
+		replayed, _ := io.ReadAll(io.MultiReader(bytes.NewReader(peeked), r))
+		if !bytes.Equal(replayed, tt.b) {
+			t.Errorf("Detect(%q) replayed %q", tt.b, replayed)
+		}
+	}
+
+	if _, _, err := Detect(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("Detect on empty input: %v, want io.EOF", err)
+	}
+}
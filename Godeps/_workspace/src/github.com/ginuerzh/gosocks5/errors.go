@@ -0,0 +1,37 @@
+package gosocks5
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ReplyCodeForError maps an error from serving a request, typically from
+// dialing the target, to the reply code to send the client. A nil error
+// maps to Succeeded and unrecognised errors to Failure.
+func ReplyCodeForError(err error) uint8 {
+	var dnsErr *net.DNSError
+
+	switch {
+	case err == nil:
+		return Succeeded
+	case errors.Is(err, ErrBadCommand):
+		return CmdUnsupported
+	case errors.Is(err, ErrBadAddrType):
+		return AddrUnsupported
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return HostUnreachable
+	case isTimeout(err):
+		return TTLExpired
+	}
+	return Failure
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrTimeout) || errors.As(err, &netErr) && netErr.Timeout()
+}
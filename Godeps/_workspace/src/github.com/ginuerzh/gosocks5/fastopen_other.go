@@ -0,0 +1,11 @@
+//go:build !linux
+
+package gosocks5
+
+import (
+	"syscall"
+)
+
+// TCP Fast Open is only supported on Linux; elsewhere the connection is made
+// as usual.
+var fastOpenControl func(network, address string, c syscall.RawConn) error
@@ -0,0 +1,75 @@
+package gosocks5
+
+import (
+	"bytes"
+	"testing"
+)
+
+var fuzzFrameSeeds = [][]byte{
+	{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50},
+	{0x05, 0x01, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x50},
+	{0x05, 0x01, 0x00, 0x03, 0x04, 'h', 'o', 's', 't', 0x00, 0x50},
+	{0x05, 0x01, 0x00, 0x03, 0x00, 0x00, 0x50},
+	{0x05, 0x01, 0x00, 0x05},
+	{0x05},
+}
+
+// fuzzFrame checks that a request or reply parsed from b re-encodes to the
+// bytes it was read from, with RSV cleared.
+func fuzzFrame(t *testing.T, b []byte, read func(*bytes.Reader) (code uint8, addr *Addr, err error)) {
+	r := bytes.NewReader(b)
+	code, addr, err := read(r)
+	if err != nil {
+		return
+	}
+
+	out, err := (&Request{Cmd: code, Addr: addr}).AppendBinary(nil)
+	if err != nil {
+		t.Fatalf("re-encoding %v: %v", addr, err)
+	}
+	want := append([]byte{}, b[:len(out)]...)
+	want[2] = 0
+	if !bytes.Equal(out, want) {
+		t.Fatalf("re-encoded % x, want % x", out, want)
+	}
+}
+
+func FuzzReadRequest(f *testing.F) {
+	for _, seed := range fuzzFrameSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		fuzzFrame(t, b, func(r *bytes.Reader) (uint8, *Addr, error) {
+			req, err := ReadRequest(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			return req.Cmd, req.Addr, nil
+		})
+	})
+}
+
+func FuzzReadReply(f *testing.F) {
+	for _, seed := range fuzzFrameSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		fuzzFrame(t, b, func(r *bytes.Reader) (uint8, *Addr, error) {
+			rep, err := ReadReply(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			return rep.Rep, rep.Addr, nil
+		})
+	})
+}
+
+func FuzzReadUDPDatagram(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0x01, 127, 0, 0, 1, 0x00, 0x35, 'd', 'a', 't', 'a'})
+	f.Add([]byte{0, 4, 0, 0x03, 0x01, 'h', 0x00, 0x35, 'd', 'a', 't', 'a'})
+	f.Add([]byte{0xff, 0xff, 0, 0x01, 127, 0, 0, 1, 0x00, 0x35})
+	f.Add([]byte{0, 0, 0, 0x04})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		ReadUDPDatagram(bytes.NewReader(b))
+	})
+}
@@ -0,0 +1,115 @@
+// Package gosocks5test provides known-good encoded SOCKS5 frames for testing
+// code built on package gosocks5. The frames are assembled by hand rather
+// than by the gosocks5 encoder. Each function returns a new slice, which the
+// caller may modify.
+//
+// It also provides in-memory connections, NewPipe and Listener, to run a
+// gosocks5 client and server against each other without sockets.
+package gosocks5test
+
+import (
+	"bytes"
+)
+
+// The values carried by the frames.
+const (
+	IPv4     = "192.0.2.1"
+	IPv6     = "2001:db8::1"
+	Domain   = "example.com"
+	Port     = 80
+	Username = "user"
+	Password = "pass"
+	Payload  = "hello"
+)
+
+// MaxDomain is a domain name of the maximum 255 bytes, as carried by
+// RequestDomainMax.
+var MaxDomain = repeat255('d')
+
+// MaxUsername and MaxPassword are credentials of the maximum 255 bytes, as
+// carried by UserPassRequestMax.
+var (
+	MaxUsername = repeat255('u')
+	MaxPassword = repeat255('p')
+)
+
+func repeat255(c byte) string {
+	return string(bytes.Repeat([]byte{c}, 255))
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var (
+	ipv4Addr   = []byte{0x01, 192, 0, 2, 1, 0, Port}
+	ipv6Addr   = []byte{0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, Port}
+	domainAddr = join([]byte{0x03, byte(len(Domain))}, []byte(Domain), []byte{0, Port})
+)
+
+// Methods is a method selection frame offering only no authentication.
+func Methods() []byte {
+	return []byte{0x05, 0x01, 0x00}
+}
+
+// MethodsMax is a method selection frame offering the maximum 255 methods,
+// 0x00 to 0xFE.
+func MethodsMax() []byte {
+	b := []byte{0x05, 0xFF}
+	for i := 0; i < 255; i++ {
+		b = append(b, byte(i))
+	}
+	return b
+}
+
+// MethodSelection is the server's choice of username/password
+// authentication.
+func MethodSelection() []byte {
+	return []byte{0x05, 0x02}
+}
+
+// UserPassRequest authenticates as Username with Password.
+func UserPassRequest() []byte {
+	return join([]byte{0x01, byte(len(Username))}, []byte(Username),
+		[]byte{byte(len(Password))}, []byte(Password))
+}
+
+// UserPassRequestMax authenticates as MaxUsername with MaxPassword.
+func UserPassRequestMax() []byte {
+	return join([]byte{0x01, 0xFF}, []byte(MaxUsername), []byte{0xFF}, []byte(MaxPassword))
+}
+
+// UserPassResponse reports a successful authentication.
+func UserPassResponse() []byte {
+	return []byte{0x01, 0x00}
+}
+
+// RequestIPv4 is a CONNECT to IPv4:Port.
+func RequestIPv4() []byte {
+	return join([]byte{0x05, 0x01, 0x00}, ipv4Addr)
+}
+
+// RequestIPv6 is a CONNECT to [IPv6]:Port.
+func RequestIPv6() []byte {
+	return join([]byte{0x05, 0x01, 0x00}, ipv6Addr)
+}
+
+// RequestDomain is a CONNECT to Domain:Port.
+func RequestDomain() []byte {
+	return join([]byte{0x05, 0x01, 0x00}, domainAddr)
+}
+
+// RequestDomainMax is a CONNECT to MaxDomain:Port.
+func RequestDomainMax() []byte {
+	return join([]byte{0x05, 0x01, 0x00, 0x03, 0xFF}, []byte(MaxDomain), []byte{0, Port})
+}
+
+// Reply is a Succeeded reply bound to IPv4:Port.
+func Reply() []byte {
+	return join([]byte{0x05, 0x00, 0x00}, ipv4Addr)
+}
+
+// UDPDatagram carries Payload for Domain:Port, unfragmented.
+func UDPDatagram() []byte {
+	return join([]byte{0x00, 0x00, 0x00}, domainAddr, []byte(Payload))
+}
@@ -0,0 +1,95 @@
+package gosocks5test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+func TestFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		read  func(b []byte) (string, error)
+		want  string
+	}{
+		{"Methods", Methods(), readMethods, "[0]"},
+		{"MethodSelection", MethodSelection(), readMethodSelection, "2"},
+		{"UserPassRequest", UserPassRequest(), readUserPassRequest, "1 " + Username + ":" + Password},
+		{"UserPassRequestMax", UserPassRequestMax(), readUserPassRequest, "1 " + MaxUsername + ":" + MaxPassword},
+		{"UserPassResponse", UserPassResponse(), readUserPassResponse, "1 0"},
+		{"RequestIPv4", RequestIPv4(), readRequest, "1 192.0.2.1:80"},
+		{"RequestIPv6", RequestIPv6(), readRequest, "1 [2001:db8::1]:80"},
+		{"RequestDomain", RequestDomain(), readRequest, "1 example.com:80"},
+		{"RequestDomainMax", RequestDomainMax(), readRequest, "1 " + MaxDomain + ":80"},
+		{"Reply", Reply(), readReply, "0 192.0.2.1:80"},
+		{"UDPDatagram", UDPDatagram(), readUDPDatagram, "example.com:80 hello"},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.read(tt.frame)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s decodes to %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if methods, err := gosocks5.ReadMethods(bytes.NewReader(MethodsMax())); err != nil || len(methods) != 255 {
+		t.Errorf("MethodsMax decodes to %d methods, %v, want 255", len(methods), err)
+	}
+}
+
+func readMethods(b []byte) (string, error) {
+	methods, err := gosocks5.ReadMethods(bytes.NewReader(b))
+	return fmt.Sprint(methods), err
+}
+
+func readMethodSelection(b []byte) (string, error) {
+	method, err := gosocks5.ReadMethodSelection(bytes.NewReader(b))
+	return fmt.Sprint(method), err
+}
+
+func readUserPassRequest(b []byte) (string, error) {
+	req, err := gosocks5.ReadUserPassRequest(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(req.Version) + " " + req.Username + ":" + req.Password, nil
+}
+
+func readUserPassResponse(b []byte) (string, error) {
+	res, err := gosocks5.ReadUserPassResponse(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(res.Version) + " " + fmt.Sprint(res.Status), nil
+}
+
+func readRequest(b []byte) (string, error) {
+	req, err := gosocks5.ReadRequest(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(req.Cmd) + " " + req.Addr.String(), nil
+}
+
+func readReply(b []byte) (string, error) {
+	rep, err := gosocks5.ReadReply(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(rep.Rep) + " " + rep.Addr.String(), nil
+}
+
+func readUDPDatagram(b []byte) (string, error) {
+	d, err := gosocks5.ParseUDPDatagram(b)
+	if err != nil {
+		return "", err
+	}
+	return d.Header.Addr.String() + " " + string(d.Data), nil
+}
@@ -0,0 +1,91 @@
+package gosocks5test
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// NewPipe returns the two ends of an in-memory connection, as net.Pipe does:
+// one for a client and one for a server. Writes on either end block until
+// the other end reads them.
+func NewPipe() (client, server net.Conn) {
+	return net.Pipe()
+}
+
+// Handshaker is a *gosocks5.Conn, as far as Handshake is concerned.
+type Handshaker interface {
+	Handleshake() error
+}
+
+// Handshake runs the handshakes of client and server, the two ends of one
+// connection such as gosocks5.ClientConn and gosocks5.ServerConn of NewPipe,
+// at once, and returns the first error of either.
+func Handshake(client, server Handshaker) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Handleshake()
+	}()
+	err := client.Handleshake()
+	if serr := <-errc; err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Listener is a net.Listener whose connections are in-memory pipes, made by
+// its DialContext, so that a gosocks5.Server can Serve it and a
+// gosocks5.Client can Dial it through Client.DialServer without sockets.
+type Listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewListener returns a Listener ready to accept connections.
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// DialContext connects to the Listener, whatever network and addr, and
+// waits for the connection to be accepted.
+func (l *Listener) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	client, server := NewPipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		err = net.ErrClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	client.Close()
+	server.Close()
+	return nil, err
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,102 @@
+package gosocks5test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+func TestHandshake(t *testing.T) {
+	auth := &gosocks5.UserPassAuthenticator{
+		Verify: func(u, p string) bool { return u == Username && p == Password },
+	}
+	serverConfig := &gosocks5.Config{SelectMethod: auth.SelectMethod, MethodSelected: auth.Authenticate}
+
+	tests := []struct {
+		name         string
+		client       *gosocks5.Client
+		serverConfig *gosocks5.Config
+		ok           bool
+	}{
+		{"no auth", &gosocks5.Client{}, nil, true},
+		{"user/pass", &gosocks5.Client{Username: Username, Password: Password}, serverConfig, true},
+		{"bad password", &gosocks5.Client{Username: Username, Password: "bad"}, serverConfig, false},
+		{"no credentials", &gosocks5.Client{}, serverConfig, false},
+	}
+	for _, tt := range tests {
+		client, server := NewPipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- gosocks5.ServerConn(server, tt.serverConfig).Handleshake()
+			server.Close()
+		}()
+		_, err := tt.client.Handshake(client)
+		client.Close()
+		serr := <-errc
+		if ok := err == nil && serr == nil; ok != tt.ok {
+			t.Errorf("%s: client %v, server %v", tt.name, err, serr)
+		}
+	}
+}
+
+func TestHandshakeConns(t *testing.T) {
+	client, server := NewPipe()
+	defer client.Close()
+	defer server.Close()
+
+	cc := gosocks5.ClientConn(client, &gosocks5.Config{Methods: []uint8{gosocks5.MethodNoAuth}})
+	sc := gosocks5.ServerConn(server, nil)
+	if err := Handshake(cc, sc); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- gosocks5.NewRequest(gosocks5.CmdConnect, &gosocks5.Addr{Type: gosocks5.AddrDomain, Host: Domain, Port: Port}).Write(cc)
+	}()
+	req, err := sc.ReadRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.Addr.String(), Domain+":80"; got != want {
+		t.Errorf("request for %s, want %s", got, want)
+	}
+}
+
+func TestClientServerPipe(t *testing.T) {
+	ln := NewListener()
+	s := &gosocks5.Server{
+		HandleRequest: func(w gosocks5.ReplyWriter, req *gosocks5.Request) error {
+			if err := w.Reply(gosocks5.Succeeded, nil); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, w)
+			return err
+		},
+	}
+	go s.Serve(ln)
+	defer ln.Close()
+
+	client := &gosocks5.Client{Addr: ln.Addr().String(), DialServer: ln.DialContext}
+	for _, target := range []string{IPv4 + ":80", "[" + IPv6 + "]:80", Domain + ":80"} {
+		conn, err := client.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("Dial %s: %v", target, err)
+		}
+		if _, err := conn.Write([]byte(Payload)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(Payload))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != Payload {
+			t.Errorf("%s: echoed %q, want %q", target, b, Payload)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,183 @@
+package gosocks5
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// Resolver resolves the domain names of CONNECT and UDP targets for a Server.
+type Resolver interface {
+	Resolve(ctx context.Context, host string) (net.IP, error)
+}
+
+// defaultResolver is the Resolver used when Server.Resolver is nil. With
+// preferIPv4, as under Server.DenyIPv6, it returns an IPv4 address of a
+// name that has one, even if its IPv6 addresses come first.
+type defaultResolver struct {
+	preferIPv4 bool
+}
+
+func (r defaultResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	family := AnyFamily
+	if r.preferIPv4 {
+		family = PreferIPv4
+	}
+	ip, _ := pickIP(ips, family)
+	return ip.IP, nil
+}
+
+// handleRequest is the request handler of a Server with neither
+// HandleRequest nor Handle set. It passes requests to the handlers
+// registered for their command, and otherwise fulfils CONNECT and UDP
+// ASSOCIATE and refuses BIND with CmdUnsupported.
+func (s *Server) handleRequest(w ReplyWriter, req *Request) error {
+	if fn, ok := s.commands[req.Cmd]; ok {
+		return fn(w, req)
+	}
+	switch req.Cmd {
+	case CmdConnect:
+		return s.handleConnect(w, req)
+	case CmdUdp:
+		return s.handleAssociate(w, req)
+	}
+	return ErrBadCommand
+}
+
+// handleConnect dials the target of req, replies with the local address of
+// the outbound connection and relays data until both sides are done.
+func (s *Server) handleConnect(w ReplyWriter, req *Request) error {
+	ctx, cancel := replyContext(w)
+	defer cancel()
+
+	raddr, err := s.resolve(ctx, req.Addr)
+	if err != nil {
+		w.Reply(HostUnreachable, nil)
+		return err
+	}
+	if s.DenyIPv6 && raddr.IP.To4() == nil {
+		return ErrBadAddrType
+	}
+
+	out, err := s.dial(ctx, "tcp", raddr.String())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if header := s.proxyHeader(w.RemoteAddr(), out.RemoteAddr()); header != nil {
+		if _, err := out.Write(header); err != nil {
+			return err
+		}
+	}
+
+	bound, err := NewAddrFromNetAddr(out.LocalAddr())
+	if err != nil {
+		return err
+	}
+	if err := w.Reply(Succeeded, bound); err != nil {
+		return err
+	}
+
+	_, _, err = Relay(w, out)
+	return err
+}
+
+// replyContext returns the context for getting the reply to the request of
+// w ready, which ends with the handshake deadline of w, if any.
+func replyContext(w ReplyWriter) (context.Context, context.CancelFunc) {
+	if conn, ok := w.(*Conn); ok && !conn.deadline.IsZero() {
+		return context.WithDeadline(context.Background(), conn.deadline)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial(ctx, network, addr)
+	}
+	dialer := &net.Dialer{LocalAddr: s.DialLocalAddr}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// handleAssociate opens a UDP relay for the client, replies with its
+// address and relays datagrams until the client closes the control
+// connection.
+func (s *Server) handleAssociate(w ReplyWriter, req *Request) error {
+	local, _ := w.LocalAddr().(*net.TCPAddr)
+	if local == nil {
+		return ErrBadFormat
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+
+	rep, err := NewUDPAssociateReply(relay.LocalAddr())
+	if err != nil {
+		return err
+	}
+	if err := w.Reply(rep.Rep, rep.Addr); err != nil {
+		return err
+	}
+
+	go func() {
+		// the association ends with the control connection
+		io.Copy(io.Discard, w)
+		relay.Close()
+	}()
+	return s.serveUDP(relay, AssociateClientAddr(req.Addr, w.RemoteAddr()))
+}
+
+// AssociateClientAddr returns the address a UDP ASSOCIATE client will send
+// its datagrams from, given the DST.ADDR of its request and the address it
+// connected to the server from. RFC 1928 lets a client that does not know
+// its UDP address yet send 0.0.0.0:0; an unspecified or missing IP is taken
+// to be that of the control connection, and a zero port matches any port.
+func AssociateClientAddr(addr *Addr, control net.Addr) *net.UDPAddr {
+	client := &net.UDPAddr{}
+	if addr != nil {
+		client.IP = addr.IP()
+		client.Port = int(addr.Port)
+		client.Zone = addr.Zone
+	}
+	if client.IP == nil || client.IP.IsUnspecified() {
+		if tcp, ok := control.(*net.TCPAddr); ok {
+			client.IP, client.Zone = tcp.IP, tcp.Zone
+		}
+	}
+	return client
+}
+
+// resolve converts addr to a TCP address, resolving a domain name with the
+// server's Resolver.
+func (s *Server) resolve(ctx context.Context, addr *Addr) (*net.TCPAddr, error) {
+	if addr.Type != AddrDomain {
+		return addr.TCPAddr()
+	}
+	if n := *addr; n.Normalize() {
+		return n.TCPAddr()
+	}
+
+	host, err := addr.ASCII()
+	if err != nil {
+		return nil, err
+	}
+	ip, err := s.resolver().Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: int(addr.Port)}, nil
+}
+
+func (s *Server) resolver() Resolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+	return defaultResolver{preferIPv4: s.DenyIPv6}
+}
@@ -0,0 +1,368 @@
+package gosocks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type mapResolver map[string]net.IP
+
+func (m mapResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	if ip, ok := m[host]; ok {
+		return ip, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestDefaultResolverPreferIPv4(t *testing.T) {
+	ip, err := defaultResolver{preferIPv4: true}.Resolve(context.Background(), "localhost")
+	if err != nil {
+		t.Skip(err)
+	}
+	if ip.To4() == nil {
+		t.Errorf("Resolve(localhost) = %v, want an IPv4 address", ip)
+	}
+}
+
+// echoTarget starts a TCP server echoing what it reads.
+func echoTarget(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestServerDefaultConnect(t *testing.T) {
+	target := echoTarget(t)
+	addr := startServer(t, &Server{
+		Resolver: mapResolver{"echo.test": target.IP},
+	})
+	client := &Client{Addr: addr.String()}
+
+	conn, err := client.Dial("tcp", net.JoinHostPort("echo.test", strconv.Itoa(target.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("echoed %q, want %q", b, "ping")
+	}
+
+	tests := []struct {
+		cmd  uint8
+		addr string
+		rep  uint8
+	}{
+		{CmdConnect, "unknown.test:80", HostUnreachable},
+		{CmdBind, "192.0.2.1:80", CmdUnsupported},
+	}
+	for _, tt := range tests {
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		target, _ := ParseAddr(tt.addr)
+		if err := NewRequest(tt.cmd, target).Write(ClientConn(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ReadReply(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Rep != tt.rep {
+			t.Errorf("command %d to %s: reply %d, want %d", tt.cmd, tt.addr, rep.Rep, tt.rep)
+		}
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	target := echoTarget(t)
+
+	for _, version := range []int{1, 2} {
+		addr := startServer(t, &Server{ProxyProtocol: version})
+
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		// read exactly the reply, leaving the echoed header to read after it
+		bc := NewBufferedConn(c)
+		if err := NewRequest(CmdConnect, NewIPAddr(target.IP, uint16(target.Port))).Write(ClientConn(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadReply(bc); err != nil {
+			t.Fatal(err)
+		}
+
+		// the target echoes the header it was sent ahead of the data
+		want := AppendProxyHeaderV2(nil, c.LocalAddr(), target)
+		if version == 1 {
+			want = AppendProxyHeaderV1(nil, c.LocalAddr(), target)
+		}
+		b := make([]byte, len(want))
+		if _, err := io.ReadFull(bc, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Errorf("version %d: target got header %q, want %q", version, b, want)
+		}
+	}
+}
+
+func TestAppendProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		src, dst net.Addr
+		want     string
+	}{
+		{
+			&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080},
+			&net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 80},
+			"PROXY TCP4 192.0.2.1 198.51.100.1 1080 80\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80},
+			"PROXY TCP6 ::ffff:192.0.2.1 2001:db8::1 1080 80\r\n",
+		},
+		{&net.UnixAddr{Name: "/tmp/sock"}, &net.TCPAddr{}, "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		if b := AppendProxyHeaderV1(nil, tt.src, tt.dst); string(b) != tt.want {
+			t.Errorf("%v -> %v: %q, want %q", tt.src, tt.dst, b, tt.want)
+		}
+	}
+}
+
+func TestAppendProxyHeaderV2(t *testing.T) {
+	sig := "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		src, dst net.Addr
+		want     string
+	}{
+		{
+			&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080},
+			&net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 80},
+			sig + "\x21\x11\x00\x0c\xc0\x00\x02\x01\xc6\x33\x64\x01\x04\x38\x00\x50",
+		},
+		{
+			&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80},
+			sig + "\x21\x21\x00\x24" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xc0\x00\x02\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x04\x38\x00\x50",
+		},
+		{&net.UnixAddr{Name: "/tmp/sock"}, &net.TCPAddr{}, sig + "\x20\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		if b := AppendProxyHeaderV2(nil, tt.src, tt.dst); string(b) != tt.want {
+			t.Errorf("%v -> %v: % x, want % x", tt.src, tt.dst, b, tt.want)
+		}
+	}
+}
+
+func TestServerDenyIPv6Resolved(t *testing.T) {
+	target := echoTarget(t)
+	addr := startServer(t, &Server{
+		DenyIPv6: true,
+		Resolver: mapResolver{"v4.test": target.IP, "v6.test": net.IPv6loopback},
+	})
+	port := uint16(target.Port)
+
+	for _, tt := range []struct {
+		target *Addr
+		want   uint8
+	}{
+		{&Addr{Type: AddrDomain, Host: "::1", Port: port}, AddrUnsupported},
+		{&Addr{Type: AddrDomain, Host: "v6.test", Port: port}, AddrUnsupported},
+		{&Addr{Type: AddrDomain, Host: "v4.test", Port: port}, Succeeded},
+	} {
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if err := NewRequest(CmdConnect, tt.target).Write(ClientConn(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ReadReply(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Rep != tt.want {
+			t.Errorf("%s: reply code = %d, want %d", tt.target, rep.Rep, tt.want)
+		}
+	}
+}
+
+func TestServerDial(t *testing.T) {
+	target := echoTarget(t)
+	dialed := make(chan string, 1)
+	addr := startServer(t, &Server{
+		// every target is routed to the echo server
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return net.Dial(network, target.String())
+		},
+	})
+
+	conn, err := (&Client{Addr: addr.String()}).Dial("tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-dialed; got != "192.0.2.1:80" {
+		t.Errorf("Dial got %s, want 192.0.2.1:80", got)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("echoed %q, want %q", b, "ping")
+	}
+}
+
+func TestServerDialLocalAddr(t *testing.T) {
+	target := echoTarget(t)
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}
+	addr := startServer(t, &Server{DialLocalAddr: local})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := NewRequest(CmdConnect, NewIPAddr(target.IP, uint16(target.Port))).Write(ClientConn(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := ReadReply(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Rep != Succeeded {
+		t.Skipf("cannot dial from %s: reply %d", local.IP, rep.Rep)
+	}
+	if rep.Addr.Host != local.IP.String() {
+		t.Errorf("BND.ADDR = %s, want host %s", rep.Addr, local.IP)
+	}
+}
+
+func TestServerDefaultAssociate(t *testing.T) {
+	addr := startServer(t, &Server{})
+	target := listenUDP(t)
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, from, err := target.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			target.WriteTo(b[:n], from)
+		}
+	}()
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the client does not know its UDP address yet
+	req := NewRequest(CmdUdp, nil)
+	b, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ReadRequest(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Cmd != CmdUdp || parsed.Addr.String() != "0.0.0.0:0" {
+		t.Errorf("request = %d %s, want %d 0.0.0.0:0", parsed.Cmd, parsed.Addr, CmdUdp)
+	}
+
+	if err := req.Write(ClientConn(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := ReadReply(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Rep != Succeeded {
+		t.Fatalf("reply code = %d, want %d", rep.Rep, Succeeded)
+	}
+	relay, err := rep.Addr.UDPAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := listenUDP(t)
+	client.WriteTo(encodeDatagram(t, target.LocalAddr(), []byte("ping")), relay)
+	buf := make([]byte, 512)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgram, err := ParseUDPDatagram(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dgram.Data) != "ping" {
+		t.Errorf("echoed %q, want %q", dgram.Data, "ping")
+	}
+}
+
+func TestAssociateClientAddr(t *testing.T) {
+	control := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 40000}
+	tests := []struct {
+		addr *Addr
+		want string
+	}{
+		{nil, "192.0.2.7:0"},
+		{&Addr{Type: AddrIPv4, Host: "0.0.0.0"}, "192.0.2.7:0"},
+		{&Addr{Type: AddrIPv4, Host: "0.0.0.0", Port: 5353}, "192.0.2.7:5353"},
+		{&Addr{Type: AddrIPv4, Host: "198.51.100.1", Port: 5353}, "198.51.100.1:5353"},
+	}
+	for _, tt := range tests {
+		if got := AssociateClientAddr(tt.addr, control).String(); got != tt.want {
+			t.Errorf("AssociateClientAddr(%v) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
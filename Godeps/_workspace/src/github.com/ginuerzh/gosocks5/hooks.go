@@ -0,0 +1,27 @@
+package gosocks5
+
+// Hooks are optional callbacks a Conn invokes as frames pass through it,
+// e.g. to export metrics. A nil *Hooks, or a nil field, is skipped.
+type Hooks struct {
+	OnRequest func(req *Request) // a request was read
+	OnReply   func(rep *Reply)   // a reply was written
+	OnError   func(err error)    // a handshake, request or reply step failed
+}
+
+func (h *Hooks) onRequest(req *Request) {
+	if h != nil && h.OnRequest != nil {
+		h.OnRequest(req)
+	}
+}
+
+func (h *Hooks) onReply(rep *Reply) {
+	if h != nil && h.OnReply != nil {
+		h.OnReply(rep)
+	}
+}
+
+func (h *Hooks) onError(err error) {
+	if h != nil && h.OnError != nil {
+		h.OnError(err)
+	}
+}
@@ -0,0 +1,60 @@
+package gosocks5
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	requests := make(chan *Request, 1)
+	replies := make(chan *Reply, 2)
+	errs := make(chan error, 1)
+	addr := startServer(t, &Server{
+		Config: &Config{Hooks: &Hooks{
+			OnRequest: func(req *Request) { requests <- req },
+			OnReply:   func(rep *Reply) { replies <- rep },
+			OnError:   func(err error) { errs <- err },
+		}},
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			return w.Reply(Succeeded, nil)
+		},
+	})
+
+	if _, rep := request(t, addr); rep.Rep != Succeeded {
+		t.Fatalf("reply code = %d, want %d", rep.Rep, Succeeded)
+	}
+	if req := <-requests; req.Cmd != CmdConnect || req.Addr.String() != "192.0.2.1:80" {
+		t.Errorf("OnRequest got %v", req)
+	}
+	if rep := <-replies; rep.Rep != Succeeded {
+		t.Errorf("OnReply got %v", rep)
+	}
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := ClientConn(c, nil).Handleshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte{Ver5, CmdConnect, 0, 9, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; !errors.Is(err, ErrBadAddrType) {
+		t.Errorf("OnError got %v, want %v", err, ErrBadAddrType)
+	}
+}
+
+func TestNilHooks(t *testing.T) {
+	var h *Hooks
+	h.onRequest(&Request{})
+	h.onReply(&Reply{})
+	h.onError(ErrBadFormat)
+
+	h = &Hooks{}
+	h.onRequest(&Request{})
+	h.onReply(&Reply{})
+	h.onError(ErrBadFormat)
+}
@@ -0,0 +1,92 @@
+package gosocks5
+
+import (
+	"net"
+	"sync"
+)
+
+// Listen announces on the TCP address addr and returns a listener of SOCKS5
+// clients. Its Accept returns a *Conn whose client has been authenticated
+// with auth, or not at all if auth is nil, and whose request has been read;
+// it is available from Conn.Request and must be answered with Conn.Reply.
+// Data the client sent behind its request has not been lost to the
+// handshake: it is read first from the Conn, or returned by Conn.Detach.
+// Clients whose handshake fails are closed and never returned.
+func Listen(addr string, auth Authenticator) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener{
+		Listener: ln,
+		config:   authConfig(auth),
+		conns:    make(chan *Conn),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+type listener struct {
+	net.Listener
+	config *Config
+	conns  chan *Conn
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func (l *listener) serve() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.fail(err)
+			return
+		}
+		go l.handshake(c)
+	}
+}
+
+// handshake negotiates with the client on c and reads its request, without
+// holding up the other clients.
+func (l *listener) handshake(c net.Conn) {
+	conn := ServerConn(c, l.config)
+	if err := conn.Handleshake(); err != nil {
+		conn.Close()
+		return
+	}
+	if _, err := conn.ReadRequest(); err != nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *listener) fail(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+	l.fail(net.ErrClosed)
+	return err
+}
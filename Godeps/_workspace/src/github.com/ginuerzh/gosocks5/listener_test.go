@@ -0,0 +1,106 @@
+package gosocks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5/gosocks5test"
+)
+
+func TestListen(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", &UserPassAuthenticator{
+		Verify: func(username, password string) bool {
+			return username == "user" && password == "pass"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		// a client failing authentication is never accepted
+		bad := &Client{Addr: ln.Addr().String(), Username: "user", Password: "bad"}
+		if conn, err := bad.Dial("tcp", "192.0.2.1:80"); err == nil {
+			conn.Close()
+		}
+
+		good := &Client{Addr: ln.Addr().String(), Username: "user", Password: "pass"}
+		conn, err := good.Dial("tcp", "192.0.2.1:80")
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("ping"))
+		conn.Close()
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := c.(*Conn)
+	if req := conn.Request(); req.Cmd != CmdConnect || req.Addr.String() != "192.0.2.1:80" {
+		t.Errorf("request = %d %s, want %d 192.0.2.1:80", req.Cmd, req.Addr, CmdConnect)
+	}
+	if err := conn.Reply(Succeeded, nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("read %q, want %q", b, "ping")
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Error("Accept succeeded after Close")
+	}
+}
+
+func TestListenPipelinedData(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	handshake := append(gosocks5test.Methods(), gosocks5test.RequestIPv4()...)
+	if _, err := c.Write(append(handshake, "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	conn := accepted.(*Conn)
+	if err := conn.Reply(Succeeded, nil); err != nil {
+		t.Fatal(err)
+	}
+	raw, buffered, err := conn.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(io.MultiReader(bytes.NewReader(buffered), raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("read %q after the request, want %q", b, "hello")
+	}
+}
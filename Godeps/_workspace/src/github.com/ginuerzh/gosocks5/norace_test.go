@@ -0,0 +1,5 @@
+//go:build !race
+
+package gosocks5
+
+const raceEnabled = false
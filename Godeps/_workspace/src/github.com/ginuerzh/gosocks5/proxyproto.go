@@ -0,0 +1,82 @@
+package gosocks5
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+// proxyHeader returns the PROXY protocol header of the version set by
+// s.ProxyProtocol, or nil if none is to be sent.
+func (s *Server) proxyHeader(src, dst net.Addr) []byte {
+	switch s.ProxyProtocol {
+	case 1:
+		return AppendProxyHeaderV1(nil, src, dst)
+	case 2:
+		return AppendProxyHeaderV2(nil, src, dst)
+	}
+	return nil
+}
+
+// AppendProxyHeaderV1 appends to dst the text header of HAProxy PROXY
+// protocol version 1 announcing a TCP connection from src to dst. If either
+// address is not a *net.TCPAddr, "PROXY UNKNOWN" is appended; an IPv4
+// address is sent as IPv4-mapped if the other one is IPv6.
+func AppendProxyHeaderV1(b []byte, src, dst net.Addr) []byte {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+
+	sip, dip := s.IP.String(), d.IP.String()
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		b = append(b, "PROXY TCP4 "...)
+	} else {
+		if s.IP.To4() != nil {
+			sip = "::ffff:" + sip
+		}
+		if d.IP.To4() != nil {
+			dip = "::ffff:" + dip
+		}
+		b = append(b, "PROXY TCP6 "...)
+	}
+	b = append(b, sip+" "+dip+" "...)
+	b = strconv.AppendInt(b, int64(s.Port), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(d.Port), 10)
+	return append(b, "\r\n"...)
+}
+
+// proxySigV2 opens every PROXY protocol version 2 header.
+var proxySigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// AppendProxyHeaderV2 appends to dst a HAProxy PROXY protocol version 2
+// header announcing a TCP connection from src to dst, so that a backend
+// behind the proxy learns the client's real address. If either address is
+// not a *net.TCPAddr, a LOCAL header carrying no addresses is appended;
+// an IPv4 address is sent as IPv4-mapped if the other one is IPv6.
+func AppendProxyHeaderV2(b []byte, src, dst net.Addr) []byte {
+	b = append(b, proxySigV2...)
+
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		// LOCAL, UNSPEC, no addresses
+		return append(b, 0x20, 0x00, 0, 0)
+	}
+
+	sip, dip := s.IP.To4(), d.IP.To4()
+	if sip != nil && dip != nil {
+		// PROXY, TCP over IPv4
+		b = append(b, 0x21, 0x11, 0, 12)
+	} else {
+		// PROXY, TCP over IPv6
+		sip, dip = s.IP.To16(), d.IP.To16()
+		b = append(b, 0x21, 0x21, 0, 36)
+	}
+	b = append(b, sip...)
+	b = append(b, dip...)
+	b = binary.BigEndian.AppendUint16(b, uint16(s.Port))
+	return binary.BigEndian.AppendUint16(b, uint16(d.Port))
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package gosocks5
+
+// raceEnabled is set when testing with the race detector, under which
+// sync.Pool drops items at random.
+const raceEnabled = true
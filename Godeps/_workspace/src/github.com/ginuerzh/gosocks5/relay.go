@@ -0,0 +1,142 @@
+package gosocks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is returned by RelayWithIdleTimeout when it tears down an
+// idle relay.
+var ErrIdleTimeout = errors.New("Idle timeout")
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Relay copies data between a and b in both directions until both are
+// done, and returns the byte counts and the first error. When one side
+// reaches EOF, the write half of the other side is closed if it supports
+// CloseWrite (as *net.TCPConn does), and the whole conn is closed otherwise.
+// Relay does not close a and b itself.
+func Relay(a, b net.Conn) (aToB, bToA int64, err error) {
+	return relay(a, b, func(dst, src net.Conn) (int64, error) {
+		return io.Copy(dst, src)
+	})
+}
+
+// RelayWithIdleTimeout is like Relay, but once no data has flowed in either
+// direction for idle, it closes both a and b and returns ErrIdleTimeout. It
+// uses the deadlines of a and b, which it clears when the relay ends without
+// timing out. An idle of zero or less means no timeout.
+func RelayWithIdleTimeout(a, b net.Conn, idle time.Duration) (aToB, bToA int64, err error) {
+	if idle <= 0 {
+		return Relay(a, b)
+	}
+
+	t := &idleTimer{idle: idle}
+	t.touch()
+	aToB, bToA, err = relay(a, b, t.copy)
+	if err == ErrIdleTimeout {
+		return
+	}
+	a.SetDeadline(time.Time{})
+	b.SetDeadline(time.Time{})
+	return
+}
+
+func relay(a, b net.Conn, cp func(dst, src net.Conn) (int64, error)) (aToB, bToA int64, err error) {
+	errc := make(chan error, 2)
+	go func() {
+		var err error
+		aToB, err = copyHalf(b, a, cp)
+		errc <- err
+	}()
+	go func() {
+		var err error
+		bToA, err = copyHalf(a, b, cp)
+		errc <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		e := <-errc
+		if e == ErrIdleTimeout {
+			// unblock the other direction too
+			a.Close()
+			b.Close()
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+func copyHalf(dst, src net.Conn, cp func(dst, src net.Conn) (int64, error)) (int64, error) {
+	n, err := cp(dst, src)
+	if cw, ok := dst.(closeWriter); !ok || cw.CloseWrite() != nil {
+		dst.Close()
+	}
+
+	// the other direction fails with ErrClosed if dst had to be closed
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return n, err
+}
+
+// idleTimer tracks the last time data flowed through a relay, in either
+// direction.
+type idleTimer struct {
+	idle time.Duration
+	last int64 // UnixNano, accessed atomically
+}
+
+func (t *idleTimer) touch() {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+func (t *idleTimer) deadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.last)).Add(t.idle)
+}
+
+// copy copies src to dst like io.Copy, with deadlines that expire once the
+// relay has been idle for t.idle. A read deadline that expires while the
+// other direction is active is pushed back.
+func (t *idleTimer) copy(dst, src net.Conn) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var n int64
+	for {
+		src.SetReadDeadline(t.deadline())
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			t.touch()
+			dst.SetWriteDeadline(t.deadline())
+			nw, werr := dst.Write(buf[:nr])
+			n += int64(nw)
+			if errors.Is(werr, os.ErrDeadlineExceeded) {
+				return n, ErrIdleTimeout
+			}
+			if werr != nil {
+				return n, werr
+			}
+			t.touch()
+		}
+
+		switch {
+		case err == nil:
+		case err == io.EOF:
+			return n, nil
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			if time.Now().Before(t.deadline()) {
+				continue
+			}
+			return n, ErrIdleTimeout
+		default:
+			return n, err
+		}
+	}
+}
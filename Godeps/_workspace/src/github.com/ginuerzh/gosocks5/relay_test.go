@@ -0,0 +1,163 @@
+package gosocks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c, s
+}
+
+func TestRelay(t *testing.T) {
+	client, a := tcpPair(t)
+	b, target := tcpPair(t)
+
+	type result struct {
+		aToB, bToA int64
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		aToB, bToA, err := Relay(a, b)
+		done <- result{aToB, bToA, err}
+	}()
+
+	// target answers only after the client has half-closed, which must
+	// reach it through the relay.
+	go func() {
+		req, _ := io.ReadAll(target)
+		target.Write(append(req, " pong"...))
+		target.(*net.TCPConn).CloseWrite()
+	}()
+
+	client.Write([]byte("ping"))
+	client.(*net.TCPConn).CloseWrite()
+	resp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "ping pong" {
+		t.Errorf("response = %q, want %q", resp, "ping pong")
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.aToB != 4 || r.bToA != 9 {
+		t.Errorf("Relay counted %d, %d bytes, want 4, 9", r.aToB, r.bToA)
+	}
+}
+
+func TestRelayWithIdleTimeout(t *testing.T) {
+	const idle = 100 * time.Millisecond
+
+	client, a := tcpPair(t)
+	b, target := tcpPair(t)
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := RelayWithIdleTimeout(a, b, idle)
+		done <- err
+	}()
+	go io.Copy(io.Discard, target)
+
+	// traffic in one direction keeps the whole relay alive past idle
+	for i := 0; i < 5; i++ {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(idle / 3)
+	}
+
+	select {
+	case err := <-done:
+		if err != ErrIdleTimeout {
+			t.Fatalf("RelayWithIdleTimeout: %v, want %v", err, ErrIdleTimeout)
+		}
+	case <-time.After(10 * idle):
+		t.Fatal("relay not torn down while idle")
+	}
+	if elapsed := time.Since(start); elapsed < 4*idle/3+idle {
+		t.Errorf("torn down after %v, before being idle for %v", elapsed, idle)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read %v after teardown, want %v", err, io.EOF)
+	}
+}
+
+func TestWriteReplyFromConn(t *testing.T) {
+	outbound, _ := tcpPair(t)
+
+	buf := &bytes.Buffer{}
+	if err := WriteReplyFromConn(buf, Succeeded, outbound); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := ReadReply(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := outbound.LocalAddr().String(); rep.Addr.String() != want {
+		t.Errorf("BND.ADDR = %s, want %s", rep.Addr, want)
+	}
+}
+
+func TestNewUDPAssociateReply(t *testing.T) {
+	relay := listenUDP(t)
+
+	rep, err := NewUDPAssociateReply(relay.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := rep.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadReply(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Rep != Succeeded {
+		t.Errorf("reply code = %d, want %d", got.Rep, Succeeded)
+	}
+	if want := relay.LocalAddr().String(); got.Addr.String() != want {
+		t.Errorf("BND.ADDR = %s, want %s", got.Addr, want)
+	}
+
+	// the control connection's address is not a relay
+	control, _ := tcpPair(t)
+	if _, err := NewUDPAssociateReply(control.LocalAddr()); err != ErrBadAddrType {
+		t.Errorf("NewUDPAssociateReply of a TCP address: %v, want %v", err, ErrBadAddrType)
+	}
+}
@@ -0,0 +1,114 @@
+package gosocks5
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachingResolver is a Resolver that remembers the answers of another, so
+// that the popular names among many CONNECT targets are not looked up again
+// for every request. Names that do not exist are remembered as well; other
+// failures, which may be passing, are not. The least recently used names
+// are forgotten first once Size is reached. A CachingResolver is safe for
+// concurrent use; its fields must not be changed once it is in use.
+type CachingResolver struct {
+	Resolver    Resolver      // the Resolver asked on a miss; nil means net.DefaultResolver
+	TTL         time.Duration // how long an answer is kept, a minute if zero
+	NegativeTTL time.Duration // how long a name not found is kept, TTL if zero
+	Size        int           // the number of names kept, 1024 if zero
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	host    string
+	ip      net.IP
+	err     error
+	expires time.Time
+}
+
+// Resolve answers from the cache if it can, asking r.Resolver otherwise.
+func (r *CachingResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	key := strings.ToLower(host)
+	if e, ok := r.lookup(key); ok {
+		return e.ip, e.err
+	}
+
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = defaultResolver{}
+	}
+	ip, err := resolver.Resolve(ctx, host)
+	ttl := r.ttl()
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		if r.NegativeTTL > 0 {
+			ttl = r.NegativeTTL
+		}
+	}
+	r.store(&cacheEntry{host: key, ip: ip, err: err, expires: time.Now().Add(ttl)})
+	return ip, err
+}
+
+func (r *CachingResolver) ttl() time.Duration {
+	if r.TTL > 0 {
+		return r.TTL
+	}
+	return time.Minute
+}
+
+func (r *CachingResolver) size() int {
+	if r.Size > 0 {
+		return r.Size
+	}
+	return 1024
+}
+
+// lookup returns the unexpired entry for host, if any.
+func (r *CachingResolver) lookup(host string) (*cacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.entries[host]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !time.Now().Before(e.expires) {
+		r.lru.Remove(el)
+		delete(r.entries, host)
+		return nil, false
+	}
+	r.lru.MoveToFront(el)
+	return e, true
+}
+
+func (r *CachingResolver) store(e *cacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.entries == nil {
+		r.entries = make(map[string]*list.Element)
+	}
+	if el, ok := r.entries[e.host]; ok {
+		el.Value = e
+		r.lru.MoveToFront(el)
+		return
+	}
+	r.entries[e.host] = r.lru.PushFront(e)
+	for r.lru.Len() > r.size() {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*cacheEntry).host)
+	}
+}
@@ -0,0 +1,104 @@
+package gosocks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingResolver answers from a map, like mapResolver, and counts the
+// lookups made. Names not in the map are not found, except flaky.test,
+// which fails as a timeout would.
+type countingResolver struct {
+	ips   map[string]net.IP
+	calls int64
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	atomic.AddInt64(&r.calls, 1)
+	if host == "flaky.test" {
+		return nil, &net.DNSError{Err: "timeout", Name: host, IsTimeout: true}
+	}
+	if ip, ok := r.ips[host]; ok {
+		return ip, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *countingResolver) count() int64 {
+	return atomic.LoadInt64(&r.calls)
+}
+
+func TestCachingResolver(t *testing.T) {
+	ip := net.IPv4(192, 0, 2, 1)
+	backend := &countingResolver{ips: map[string]net.IP{"a.test": ip, "b.test": ip, "c.test": ip}}
+	r := &CachingResolver{Resolver: backend, TTL: 50 * time.Millisecond, Size: 2}
+	ctx := context.Background()
+
+	resolve := func(host string) error {
+		t.Helper()
+		_, err := r.Resolve(ctx, host)
+		return err
+	}
+	expect := func(what string, calls int64) {
+		t.Helper()
+		if n := backend.count(); n != calls {
+			t.Errorf("%s: %d lookups, want %d", what, n, calls)
+		}
+	}
+
+	for _, host := range []string{"a.test", "a.test", "A.TEST"} {
+		got, err := r.Resolve(ctx, host)
+		if err != nil || !got.Equal(ip) {
+			t.Fatalf("Resolve(%s) = %v, %v", host, got, err)
+		}
+	}
+	expect("repeated name", 1)
+
+	var dnsErr *net.DNSError
+	for i := 0; i < 2; i++ {
+		if err := resolve("missing.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("Resolve(missing.test): %v, want not found", err)
+		}
+	}
+	expect("name not found", 2)
+
+	resolve("flaky.test")
+	resolve("flaky.test")
+	expect("failing lookup", 4)
+
+	// missing.test and a.test fill the cache; b.test evicts missing.test,
+	// the least recently used
+	resolve("a.test")
+	resolve("b.test")
+	resolve("a.test")
+	expect("within size", 5)
+	resolve("missing.test")
+	expect("evicted", 6)
+
+	time.Sleep(60 * time.Millisecond)
+	resolve("a.test")
+	expect("expired", 7)
+}
+
+func TestCachingResolverConcurrent(t *testing.T) {
+	backend := &countingResolver{ips: map[string]net.IP{"a.test": net.IPv4(192, 0, 2, 1)}}
+	r := &CachingResolver{Resolver: backend, Size: 1}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.Resolve(context.Background(), "a.test")
+				r.Resolve(context.Background(), "missing.test")
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,455 @@
+package gosocks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("Server closed")
+
+// ReplyWriter is the client connection as seen by a HandleRequest function.
+// Reply answers the request; it fails with ErrBadState if the request has
+// already been answered, except for the second reply of a successful BIND.
+// The reply must be sent with Reply rather than written to the connection,
+// so that the server knows it was sent.
+type ReplyWriter interface {
+	net.Conn
+	Reply(rep uint8, addr *Addr) error
+}
+
+// Server accepts SOCKS5 clients, performs the method negotiation and hands
+// the negotiated connection to HandleRequest or Handle. With neither set, it
+// passes requests to the handlers registered with HandleConnect, HandleBind
+// and HandleUDP, and otherwise fulfils CONNECT and UDP ASSOCIATE requests
+// itself and refuses BIND.
+type Server struct {
+	Addr   string // TCP address to listen on, ":1080" if empty
+	Config *Config
+	Handle func(conn net.Conn, method uint8) error
+
+	// HandleRequest, if set, takes precedence over Handle and is called
+	// with the client's request already read. If it returns an error before
+	// replying, the server replies with NewReplyFromError. The connection is
+	// closed once it returns.
+	HandleRequest func(w ReplyWriter, req *Request) error
+
+	// ShutdownContext, if set, puts the server into drain mode once it is
+	// done: clients are still negotiated, but their request is answered
+	// with a Failure reply and the connection is closed.
+	ShutdownContext context.Context
+
+	// TargetFilter, if set, is consulted for every UDP datagram relayed on
+	// behalf of a client. Datagrams whose target it rejects are dropped.
+	TargetFilter func(addr *Addr) bool
+
+	// Resolver resolves the domain names of CONNECT targets for the default
+	// request handler, used when neither HandleRequest nor Handle is set. If
+	// nil, net.DefaultResolver is used. A failure is replied to with
+	// HostUnreachable.
+	Resolver Resolver
+
+	// DialLocalAddr, if set, is the local address the default request
+	// handler dials CONNECT targets from, e.g. to pick the egress interface
+	// of a multi-homed host. The reply carries the address actually bound.
+	DialLocalAddr net.Addr
+
+	// Dial, if set, makes the connections of the default request handler to
+	// CONNECT targets instead of a net.Dialer, e.g. to route them through
+	// another transport or to fake them in tests. DialLocalAddr is then
+	// ignored. addr is the target's resolved "ip:port".
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// ProxyProtocol, if 1 or 2, makes the default request handler send a
+	// PROXY protocol header of that version on every connection it dials for
+	// a CONNECT, before any of the client's data, so that the target learns
+	// the client's address. Zero sends none. See AppendProxyHeaderV1 and
+	// AppendProxyHeaderV2.
+	ProxyProtocol int
+
+	// HandshakeTimeout, if positive, bounds the time from accepting a
+	// connection to replying to its request, negotiation, authentication
+	// and dialing the target included. A client that has not been replied
+	// to by then is disconnected, and the error is ErrTimeout. Once the
+	// reply is written, the connection has no deadline.
+	HandshakeTimeout time.Duration
+
+	// TLSConfig, if set, makes the server expect TLS on every connection it
+	// accepts, running the SOCKS5 negotiation inside it, e.g. for clients
+	// with Client.TLSConfig set. The TLS handshake counts towards
+	// HandshakeTimeout.
+	TLSConfig *tls.Config
+
+	// MaxConns, if positive, limits the number of connections served at once.
+	// Connections beyond it are closed as soon as they are accepted.
+	MaxConns int
+
+	// Admit, if set, is called with the address of every accepted client
+	// before the negotiation. Clients it rejects are closed immediately,
+	// e.g. to enforce per-IP rate limits.
+	Admit func(remote net.Addr) bool
+
+	// DenyIPv6 refuses requests for IPv6 targets with AddrUnsupported, e.g.
+	// where IPv6 egress is not routed. IPv6 addresses, including IPv6
+	// literals sent as a domain, are refused before the request reaches
+	// HandleRequest or the default handler; the default handler also refuses
+	// a domain that resolves to IPv6 only, taking its IPv4 address if it has
+	// one when Resolver is nil, and the UDP relay drops datagrams for IPv6
+	// targets. IPv6 is allowed by default.
+	DenyIPv6 bool
+
+	// AllowedCommands, if set, lists the commands the server accepts, e.g.
+	// only CmdConnect. Other requests are refused with CmdUnsupported
+	// before they reach HandleRequest or the default handler.
+	AllowedCommands []uint8
+
+	// Logger, if set, receives the server's structured logs: failures at
+	// WARN or ERROR, a line per served request at INFO, and the steps of
+	// each connection at DEBUG.
+	Logger *slog.Logger
+
+	methods    map[uint8]func(conn net.Conn) error
+	commands   map[uint8]func(w ReplyWriter, req *Request) error
+	droppedUDP uint64
+	conns      int64
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	active    sync.WaitGroup
+}
+
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":1080"
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on l until it fails or Shutdown closes it, in
+// which case ErrServerClosed is returned.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			s.logger().Error("accept failed", "addr", l.Addr().String(), "err", err)
+			return err
+		}
+
+		if !s.admit(conn) {
+			s.logger().Info("connection refused", "remote", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			atomic.AddInt64(&s.conns, -1)
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.active.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.active.Done()
+			defer atomic.AddInt64(&s.conns, -1)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Shutdown closes the server's listeners and waits for the connections in
+// flight to finish, or for ctx to be done, whichever comes first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// admit applies MaxConns and Admit to conn, counting it as live if it is
+// let in.
+func (s *Server) admit(conn net.Conn) bool {
+	if s.Admit != nil && !s.Admit(conn.RemoteAddr()) {
+		return false
+	}
+	if n := atomic.AddInt64(&s.conns, 1); s.MaxConns > 0 && n > int64(s.MaxConns) {
+		atomic.AddInt64(&s.conns, -1)
+		return false
+	}
+	return true
+}
+
+// Conns returns the number of connections being served.
+func (s *Server) Conns() int {
+	return int(atomic.LoadInt64(&s.conns))
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	start := time.Now()
+	log := s.logger().With("remote", c.RemoteAddr().String())
+
+	if s.TLSConfig != nil {
+		c = tls.Server(c, s.TLSConfig)
+	}
+	conn := ServerConn(c, s.config())
+	if s.HandshakeTimeout > 0 {
+		conn.deadline = start.Add(s.HandshakeTimeout)
+		c.SetDeadline(conn.deadline)
+	}
+	if err := conn.Handleshake(); err != nil {
+		err = timeoutErr(err)
+		if conn.state >= stateNegotiated {
+			log.Warn("authentication failed", "method", conn.method, "err", err)
+		} else {
+			log.Warn("negotiation failed", "err", err)
+		}
+		conn.Close()
+		return
+	}
+	if conn.identity != "" {
+		log = log.With("user", conn.identity)
+	}
+	log.Debug("negotiated", "method", conn.method)
+
+	if s.draining() {
+		log.Debug("rejecting request while draining")
+		s.reject(conn)
+		return
+	}
+
+	if s.HandleRequest == nil && s.Handle != nil {
+		log.Debug("handing off to Handle")
+		// Handle may answer without WriteReply
+		c.SetDeadline(time.Time{})
+		if err := s.Handle(conn, conn.method); err != nil {
+			log.Warn("handle failed", "duration", time.Since(start), "err", timeoutErr(err))
+			return
+		}
+		log.Info("handle done", "duration", time.Since(start))
+		return
+	}
+	s.serveRequest(conn, log, start)
+}
+
+func (s *Server) serveRequest(conn *Conn, log *slog.Logger, start time.Time) {
+	defer conn.Close()
+
+	req, err := conn.ReadRequest()
+	if err != nil {
+		err = timeoutErr(err)
+		if err != io.EOF {
+			log.Warn("reading request failed", "err", err)
+		}
+		conn.CloseWithError(err)
+		return
+	}
+	log = log.With("cmd", req.Cmd, "target", req.Addr.String())
+	log.Debug("request")
+
+	if !s.allowed(req.Cmd) {
+		log.Info("command refused")
+		conn.Reply(CmdUnsupported, nil)
+		return
+	}
+	if s.DenyIPv6 && isIPv6(req.Addr) {
+		log.Info("IPv6 target refused")
+		conn.Reply(AddrUnsupported, nil)
+		return
+	}
+
+	handle := s.HandleRequest
+	if handle == nil {
+		handle = s.handleRequest
+	}
+	err = handle(conn, req)
+	if err != nil {
+		err = timeoutErr(err)
+		conn.CloseWithError(err)
+		log.Warn("request failed", "rep", conn.rep, "duration", time.Since(start), "err", err)
+		return
+	}
+	log.Info("request done", "rep", conn.rep, "duration", time.Since(start))
+}
+
+func (s *Server) allowed(cmd uint8) bool {
+	return len(s.AllowedCommands) == 0 || bytes.IndexByte(s.AllowedCommands, cmd) >= 0
+}
+
+// isIPv6 reports whether addr is an IPv6 address, counting an IPv6 literal
+// sent as a domain, which the server would dial as such.
+func isIPv6(addr *Addr) bool {
+	n := *addr
+	n.Normalize()
+	return n.Type == AddrIPv6
+}
+
+// discardLogger stands in for a nil Server.Logger.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return discardLogger
+}
+
+// RegisterMethod adds support for the authentication method with code
+// method, typically one in the private range 0x80 to 0xFE. A client offering
+// it gets it selected, ahead of the methods of Config, and handler runs the
+// sub-negotiation on the connection; an error fails the handshake.
+// RegisterMethod must not be called once the server is serving.
+func (s *Server) RegisterMethod(method uint8, handler func(conn net.Conn) error) {
+	if s.methods == nil {
+		s.methods = make(map[uint8]func(conn net.Conn) error)
+	}
+	s.methods[method] = handler
+}
+
+// HandleConnect makes fn the handler of CONNECT requests in place of the
+// built-in one, which dials the target and relays; a nil fn restores it.
+// Like HandleBind and HandleUDP, it applies to the default request handler,
+// used when neither HandleRequest nor Handle is set, and must not be called
+// once the server is serving.
+func (s *Server) HandleConnect(fn func(w ReplyWriter, req *Request) error) {
+	s.handleCommand(CmdConnect, fn)
+}
+
+// HandleBind makes fn the handler of BIND requests, which are refused with
+// CmdUnsupported by default or if fn is nil.
+func (s *Server) HandleBind(fn func(w ReplyWriter, req *Request) error) {
+	s.handleCommand(CmdBind, fn)
+}
+
+// HandleUDP makes fn the handler of UDP ASSOCIATE requests in place of the
+// built-in relay; a nil fn restores it.
+func (s *Server) HandleUDP(fn func(w ReplyWriter, req *Request) error) {
+	s.handleCommand(CmdUdp, fn)
+}
+
+func (s *Server) handleCommand(cmd uint8, fn func(w ReplyWriter, req *Request) error) {
+	if fn == nil {
+		delete(s.commands, cmd)
+		return
+	}
+	if s.commands == nil {
+		s.commands = make(map[uint8]func(w ReplyWriter, req *Request) error)
+	}
+	s.commands[cmd] = fn
+}
+
+// config returns s.Config extended with the registered methods.
+func (s *Server) config() *Config {
+	if len(s.methods) == 0 {
+		return s.Config
+	}
+
+	var base Config
+	if s.Config != nil {
+		base = *s.Config
+	}
+	config := base
+	config.SelectMethod = func(methods ...uint8) uint8 {
+		for _, method := range methods {
+			if _, ok := s.methods[method]; ok {
+				return method
+			}
+		}
+		if base.SelectMethod != nil {
+			return base.SelectMethod(methods...)
+		}
+		return selectNoAuth(methods)
+	}
+	config.Authenticate = func(method uint8, conn net.Conn) (net.Conn, string, error) {
+		if handler, ok := s.methods[method]; ok {
+			if err := handler(conn); err != nil {
+				return nil, "", err
+			}
+			return conn, "", nil
+		}
+		return base.authenticate(method, conn)
+	}
+	return &config
+}
+
+func (s *Server) draining() bool {
+	if s.ShutdownContext == nil {
+		return false
+	}
+	return s.ShutdownContext.Err() != nil
+}
+
+// reject reads the pending request and refuses it with a Failure reply.
+func (s *Server) reject(conn *Conn) {
+	defer conn.Close()
+
+	if _, err := conn.ReadRequest(); err != nil {
+		return
+	}
+	conn.WriteReply(NewReply(Failure, nil))
+}
@@ -0,0 +1,703 @@
+package gosocks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5/gosocks5test"
+)
+
+func startServer(t *testing.T, s *Server) net.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go s.Serve(ln)
+	return ln.Addr()
+}
+
+func TestServerShutdownRejectsRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	handled := make(chan struct{}, 1)
+	addr := startServer(t, &Server{
+		ShutdownContext: ctx,
+		Handle: func(conn net.Conn, method uint8) error {
+			handled <- struct{}{}
+			return conn.Close()
+		},
+	})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := ClientConn(c, nil)
+	if err := conn.Handleshake(); err != nil {
+		t.Fatal(err)
+	}
+	req := NewRequest(CmdConnect, &Addr{Type: AddrIPv4, Host: "127.0.0.1", Port: 80})
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Rep != Failure {
+		t.Errorf("reply code = %d, want %d", rep.Rep, Failure)
+	}
+
+	select {
+	case <-handled:
+		t.Error("Handle called while draining")
+	default:
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	handling := make(chan struct{})
+	s := &Server{
+		Handle: func(conn net.Conn, method uint8) error {
+			close(handling)
+			<-release
+			return conn.Close()
+		},
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := ClientConn(c, nil).Handleshake(); err != nil {
+		t.Fatal(err)
+	}
+	<-handling
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve: %v, want %v", err, ErrServerClosed)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a connection in flight", err)
+	default:
+	}
+
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+// request negotiates with the server at addr, sends a CONNECT and returns
+// the connection along with the reply.
+func request(t *testing.T, addr net.Addr) (net.Conn, *Reply) {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	conn := ClientConn(c, nil)
+	req := NewRequest(CmdConnect, &Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 80})
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := ReadReply(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, rep
+}
+
+func TestServerPipelinedUserPass(t *testing.T) {
+	addr := startServer(t, &Server{
+		Config: authConfig(&UserPassAuthenticator{
+			Verify: func(u, p string) bool { return u == gosocks5test.Username && p == gosocks5test.Password },
+		}),
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			return w.Reply(Succeeded, nil)
+		},
+	})
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{Ver5, 1, MethodUserPass}); err != nil {
+		t.Fatal(err)
+	}
+	if method, err := ReadMethodSelection(conn); err != nil || method != MethodUserPass {
+		t.Fatalf("method selection = %d, %v", method, err)
+	}
+	// the userpass and CONNECT requests in one segment
+	if _, err := conn.Write(append(gosocks5test.UserPassRequest(), gosocks5test.RequestIPv4()...)); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ReadUserPassResponse(conn); err != nil || !res.OK() {
+		t.Fatalf("userpass response = %+v, %v", res, err)
+	}
+	rep, err := ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Rep != Succeeded {
+		t.Errorf("reply code = %d, want %d", rep.Rep, Succeeded)
+	}
+}
+
+func TestServerHandleRequestError(t *testing.T) {
+	addr := startServer(t, &Server{
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			return ErrBadCommand
+		},
+	})
+
+	_, rep := request(t, addr)
+	if rep.Rep != CmdUnsupported {
+		t.Errorf("reply code = %d, want %d", rep.Rep, CmdUnsupported)
+	}
+}
+
+func TestServerBadRequestReply(t *testing.T) {
+	addr := startServer(t, &Server{
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			return w.Reply(Succeeded, nil)
+		},
+	})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := ClientConn(c, nil).Handleshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte{Ver5, CmdConnect, 0, 9, 192, 0, 2, 1, 0, 80}); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := ReadReply(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Rep != AddrUnsupported {
+		t.Errorf("reply code = %d, want %d", rep.Rep, AddrUnsupported)
+	}
+}
+
+func TestServerHandleRequestRepliesOnce(t *testing.T) {
+	errc := make(chan error, 1)
+	addr := startServer(t, &Server{
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			if err := w.Reply(Succeeded, nil); err != nil {
+				return err
+			}
+			errc <- w.Reply(Failure, nil)
+			return ErrBadCommand
+		},
+	})
+
+	c, rep := request(t, addr)
+	if rep.Rep != Succeeded {
+		t.Errorf("reply code = %d, want %d", rep.Rep, Succeeded)
+	}
+	if err := <-errc; err != ErrBadState {
+		t.Errorf("second Reply: %v, want %v", err, ErrBadState)
+	}
+	if b, err := io.ReadAll(c); err != nil || len(b) != 0 {
+		t.Errorf("read %q, %v after the reply, want nothing", b, err)
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	release := make(chan struct{})
+	s := &Server{
+		MaxConns: 1,
+		Handle: func(conn net.Conn, method uint8) error {
+			<-release
+			return conn.Close()
+		},
+	}
+	addr := startServer(t, s)
+	defer close(release)
+
+	first, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if err := ClientConn(first, nil).Handleshake(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Conns(); n != 1 {
+		t.Errorf("Conns() = %d, want 1", n)
+	}
+
+	second, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err := ClientConn(second, nil).Handleshake(); err == nil {
+		t.Error("connection over MaxConns was served")
+	}
+}
+
+func TestServerAdmit(t *testing.T) {
+	addr := startServer(t, &Server{
+		Admit: func(remote net.Addr) bool { return false },
+	})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := ClientConn(c, nil).Handleshake(); err == nil {
+		t.Error("rejected connection was served")
+	}
+}
+
+func TestServerRegisterMethod(t *testing.T) {
+	const methodPrivate = 0x80
+
+	s := &Server{
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			return w.Reply(Succeeded, nil)
+		},
+	}
+	s.RegisterMethod(methodPrivate, func(conn net.Conn) error {
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if string(b) != "token" {
+			return ErrAuthFailure
+		}
+		_, err := conn.Write([]byte{Succeeded})
+		return err
+	})
+	addr := startServer(t, s)
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := ClientConn(c, &Config{
+		Methods: []uint8{MethodNoAuth, methodPrivate},
+		MethodSelected: func(method uint8, conn net.Conn) (net.Conn, error) {
+			if method != methodPrivate {
+				return nil, ErrBadMethod
+			}
+			if _, err := conn.Write([]byte("token")); err != nil {
+				return nil, err
+			}
+			b := make([]byte, 1)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return nil, err
+			}
+			return conn, nil
+		},
+	})
+	if err := NewRequest(CmdConnect, NewIPAddr(net.IPv4(192, 0, 2, 1), 80)).Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := ReadReply(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Rep != Succeeded {
+		t.Errorf("reply code = %d, want %d", rep.Rep, Succeeded)
+	}
+
+	// neither the registered method nor MethodNoAuth is offered
+	c2, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	err = ClientConn(c2, &Config{Methods: []uint8{MethodGSSAPI}}).Handleshake()
+	if !errors.Is(err, ErrNoAcceptableMethod) {
+		t.Errorf("Handleshake offering only GSSAPI: %v, want %v", err, ErrNoAcceptableMethod)
+	}
+}
+
+func TestServerBindDomainHint(t *testing.T) {
+	hint := &Addr{Type: AddrDomain, Host: "peer.example.com", Port: 2121}
+	got := make(chan *Request, 1)
+	addr := startServer(t, &Server{
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			got <- req
+			return w.Reply(NotAllowed, nil)
+		},
+	})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := NewRequest(CmdBind, hint).Write(ClientConn(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-got
+	if req.Cmd != CmdBind || *req.Addr != *hint {
+		t.Errorf("handler got %d %+v, want %d %+v", req.Cmd, req.Addr, CmdBind, hint)
+	}
+}
+
+func TestServerAllowedCommands(t *testing.T) {
+	addr := startServer(t, &Server{
+		AllowedCommands: []uint8{CmdConnect},
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			return w.Reply(Succeeded, nil)
+		},
+	})
+
+	target := NewIPAddr(net.IPv4(192, 0, 2, 1), 80)
+	for _, tt := range []struct {
+		cmd  uint8
+		want uint8
+	}{
+		{CmdConnect, Succeeded},
+		{CmdUdp, CmdUnsupported},
+		{CmdBind, CmdUnsupported},
+	} {
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if err := NewRequest(tt.cmd, target).Write(ClientConn(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ReadReply(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Rep != tt.want {
+			t.Errorf("command %d: reply code = %d, want %d", tt.cmd, rep.Rep, tt.want)
+		}
+	}
+}
+
+func TestServerHandleCommands(t *testing.T) {
+	handled := make(chan uint8, 1)
+	handler := func(w ReplyWriter, req *Request) error {
+		handled <- req.Cmd
+		return w.Reply(Succeeded, nil)
+	}
+
+	target := NewIPAddr(net.IPv4(192, 0, 2, 1), 80)
+	for _, tt := range []struct {
+		name     string
+		register func(s *Server)
+		cmd      uint8
+		want     uint8
+	}{
+		{"connect", func(s *Server) { s.HandleConnect(handler) }, CmdConnect, Succeeded},
+		{"bind", func(s *Server) { s.HandleBind(handler) }, CmdBind, Succeeded},
+		{"udp", func(s *Server) { s.HandleUDP(handler) }, CmdUdp, Succeeded},
+		{"unregistered bind", func(s *Server) { s.HandleConnect(handler) }, CmdBind, CmdUnsupported},
+		{"bind reset", func(s *Server) { s.HandleBind(handler); s.HandleBind(nil) }, CmdBind, CmdUnsupported},
+	} {
+		s := &Server{}
+		tt.register(s)
+		addr := startServer(t, s)
+
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err := NewRequest(tt.cmd, target).Write(ClientConn(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ReadReply(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Rep != tt.want {
+			t.Errorf("%s: reply code = %d, want %d", tt.name, rep.Rep, tt.want)
+		}
+		select {
+		case cmd := <-handled:
+			if tt.want != Succeeded || cmd != tt.cmd {
+				t.Errorf("%s: handler called for command %d", tt.name, cmd)
+			}
+		default:
+			if tt.want == Succeeded {
+				t.Errorf("%s: handler not called", tt.name)
+			}
+		}
+	}
+}
+
+func TestServerDenyIPv6(t *testing.T) {
+	addr := startServer(t, &Server{
+		DenyIPv6: true,
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			return w.Reply(Succeeded, nil)
+		},
+	})
+
+	for _, tt := range []struct {
+		target *Addr
+		want   uint8
+	}{
+		{NewIPAddr(net.ParseIP("2001:db8::1"), 80), AddrUnsupported},
+		{NewIPAddr(net.IPv4(192, 0, 2, 1), 80), Succeeded},
+	} {
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if err := NewRequest(CmdConnect, tt.target).Write(ClientConn(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ReadReply(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Rep != tt.want {
+			t.Errorf("%s: reply code = %d, want %d", tt.target, rep.Rep, tt.want)
+		}
+	}
+}
+
+// recordHandler is a slog.Handler sending the records it handles to a
+// channel, with the attributes of the logger inlined.
+type recordHandler struct {
+	records chan slog.Record
+	attrs   []slog.Attr
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	r = r.Clone()
+	r.AddAttrs(h.attrs...)
+	h.records <- r
+	return nil
+}
+
+func (h *recordHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &recordHandler{records: h.records, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *recordHandler) WithGroup(string) slog.Handler { return h }
+
+func TestServerLogger(t *testing.T) {
+	h := &recordHandler{records: make(chan slog.Record, 16)}
+	addr := startServer(t, &Server{
+		Logger: slog.New(h),
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			return ErrBadCommand
+		},
+	})
+	request(t, addr)
+
+	for {
+		var r slog.Record
+		select {
+		case r = <-h.records:
+		case <-time.After(time.Second):
+			t.Fatal("request failure not logged")
+		}
+		if r.Message != "request failed" {
+			continue
+		}
+		if r.Level != slog.LevelWarn {
+			t.Errorf("level = %v, want %v", r.Level, slog.LevelWarn)
+		}
+		attrs := map[string]string{}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.String()
+			return true
+		})
+		for key, want := range map[string]string{"cmd": "1", "target": "192.0.2.1:80", "rep": "7"} {
+			if attrs[key] != want {
+				t.Errorf("%s = %q, want %q", key, attrs[key], want)
+			}
+		}
+		if attrs["remote"] == "" || attrs["duration"] == "" {
+			t.Errorf("remote or duration missing from %v", attrs)
+		}
+		return
+	}
+}
+
+func TestServerIdentity(t *testing.T) {
+	h := &recordHandler{records: make(chan slog.Record, 16)}
+	identities := make(chan string, 2)
+	s := &Server{
+		Logger: slog.New(h),
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			identities <- w.(*Conn).Identity()
+			return w.Reply(Succeeded, nil)
+		},
+	}
+	noAuth := startServer(t, s)
+	userPass := startServer(t, &Server{
+		Config: authConfig(&UserPassAuthenticator{
+			Verify: func(u, p string) bool { return u == "alice" && p == "a" },
+		}),
+		Logger:        s.Logger,
+		HandleRequest: s.HandleRequest,
+	})
+
+	for _, tt := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{noAuth, ""},
+		{userPass, "alice"},
+	} {
+		client := &Client{Addr: tt.addr.String(), Username: "alice", Password: "a"}
+		conn, err := client.Dial("tcp", "192.0.2.1:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got := <-identities; got != tt.want {
+			t.Errorf("Identity() = %q, want %q", got, tt.want)
+		}
+	}
+
+	// the request of alice is logged as hers
+	for {
+		var r slog.Record
+		select {
+		case r = <-h.records:
+		case <-time.After(time.Second):
+			t.Fatal("request of alice not logged")
+		}
+		user := ""
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "user" {
+				user = a.Value.String()
+			}
+			return true
+		})
+		if r.Message == "request done" && user == "alice" {
+			return
+		}
+	}
+}
+
+func TestServerPipelinedData(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		received <- string(b)
+	}()
+	addr := startServer(t, &Server{})
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	target, _ := NewAddrFromNetAddr(ln.Addr())
+	req, err := NewRequest(CmdConnect, target).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the whole handshake and the first data in one write
+	if _, err := conn.Write(append(append(gosocks5test.Methods(), req...), "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	select {
+	case got := <-received:
+		if got != "hello" {
+			t.Errorf("target received %q, want %q", got, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target received nothing")
+	}
+}
+
+func TestServerLoggerHandleError(t *testing.T) {
+	h := &recordHandler{records: make(chan slog.Record, 16)}
+	addr := startServer(t, &Server{
+		Logger: slog.New(h),
+		Handle: func(conn net.Conn, method uint8) error {
+			defer conn.Close()
+			return ErrBadCommand
+		},
+	})
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := ClientConn(conn, nil).Handleshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		var r slog.Record
+		select {
+		case r = <-h.records:
+		case <-time.After(time.Second):
+			t.Fatal("Handle failure not logged")
+		}
+		if r.Message != "handle failed" {
+			continue
+		}
+		attrs := map[string]string{}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.String()
+			return true
+		})
+		if r.Level != slog.LevelWarn || attrs["err"] != ErrBadCommand.Error() || attrs["remote"] == "" {
+			t.Errorf("logged %v %v, want a warning with err and remote", r.Level, attrs)
+		}
+		return
+	}
+}
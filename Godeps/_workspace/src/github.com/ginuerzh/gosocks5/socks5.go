@@ -1,17 +1,33 @@
 // SOCKS Protocol Version 5
 // http://tools.ietf.org/html/rfc1928
 // http://tools.ietf.org/html/rfc1929
+//
+// The Read functions return io.EOF only if the input ends before the first
+// byte of a frame, and io.ErrUnexpectedEOF if it ends partway through one,
+// so a clean disconnect can be told apart from a truncated frame. Other
+// errors name the frame being decoded and wrap one of the Err values of this
+// package or an I/O error; test for them with errors.Is. Such errors are a
+// *FrameError, which also tells how much of the input was consumed.
+//
+// What the Read functions allocate per call is bounded by the frame format,
+// not by what the peer declares: at most 513 bytes, a username/password
+// request, for the handshake, request and reply frames. ReadUDPDatagram
+// reads into a pooled buffer of MaxUDPDatagramSize and allocates only the
+// datagram it returns, so a malformed or truncated datagram costs no more
+// than the error.
 package gosocks5
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	//"log"
 	"net"
+	"slices"
 	"strconv"
+	"sync"
 )
 
 const (
@@ -28,6 +44,13 @@ const (
 	MethodNoAcceptable = 0xFF
 )
 
+// Status codes of a username/password response. RFC 1929 takes any status
+// other than AuthSuccess as a failure.
+const (
+	AuthSuccess uint8 = 0x00
+	AuthFailure uint8 = 0x01
+)
+
 const (
 	CmdConnect uint8 = 1
 	CmdBind          = 2
@@ -38,8 +61,17 @@ const (
 	AddrIPv4   uint8 = 1
 	AddrDomain       = 3
 	AddrIPv6         = 4
+
+	// AddrUnix is a non-standard address type, not part of RFC 1928, for a
+	// Unix domain socket path. It is encoded like AddrDomain, with a port
+	// that is ignored, and only accepted if EnableUnixAddr is set.
+	AddrUnix = 0x80
 )
 
+// EnableUnixAddr opts in to AddrUnix addresses; otherwise they are rejected
+// with ErrBadAddrType like any unknown type. Set it before using the package.
+var EnableUnixAddr = false
+
 const (
 	Succeeded uint8 = iota
 	Failure
@@ -59,8 +91,183 @@ var (
 	ErrShortBuffer = errors.New("Short buffer")
 	ErrBadMethod   = errors.New("Bad method")
 	ErrAuthFailure = errors.New("Auth failure")
+	ErrTimeout     = errors.New("Timeout")
+	ErrBadState    = errors.New("Bad state")
+	ErrBadCommand  = errors.New("Bad command")
+
+	ErrBadReplyCode = errors.New("Bad reply code")
+
+	ErrNoAcceptableMethod = errors.New("No acceptable method")
+	ErrNotSocks5          = errors.New("Not SOCKS5")
 )
 
+// DecodeOptions tunes how strictly the *WithOptions readers parse frames.
+// The zero value, also used by the plain Read functions, is lenient.
+type DecodeOptions struct {
+	// StrictRSV rejects frames whose RSV field is not zero with ErrBadFormat.
+	// UDP datagrams, which have no version to check, are also rejected for
+	// FRAG 0x80, the end of a fragment sequence at position 0, which RFC
+	// 1928 leaves without meaning.
+	StrictRSV bool
+
+	// StrictReplyCode rejects replies whose REP field is not one of the
+	// codes RFC 1928 defines, Succeeded to AddrUnsupported, with
+	// ErrBadReplyCode.
+	StrictReplyCode bool
+
+	// LenientReplyAddr accepts replies with no usable BND.ADDR, as some
+	// servers send, and gives them the address 0.0.0.0:0: a reply with ATYP
+	// 0, which is taken to end right after ATYP, and a Succeeded reply cut
+	// short by the end of the stream, as from a server that closes its side
+	// after replying. The version must still be 5.
+	LenientReplyAddr bool
+
+	// RejectMappedIPv4 rejects IPv6 addresses that are IPv4-mapped
+	// (::ffff:a.b.c.d) with ErrBadAddrType; see Addr.Canonicalize.
+	RejectMappedIPv4 bool
+
+	// MaxUDPDatagramSize caps the size of a UDP datagram, header included,
+	// and so the buffer allocated for it. Zero means MaxUDPDatagramSize.
+	MaxUDPDatagramSize int
+
+	// QuirkMode accepts requests from clients that leave out the RSV byte
+	// and send VER | CMD | ATYP | ADDR | PORT. Such a request is told by a
+	// third byte that is a standard ATYP followed by one that is not a known
+	// ATYP; when the fourth byte could be either, e.g. an IPv4 address
+	// starting with 1, 3 or 4, the request is read as a well-formed one.
+	// This is a hack for interoperating with broken clients; see also
+	// StrictRSV, which it overrides only for requests taken to lack RSV.
+	QuirkMode bool
+}
+
+// MaxUDPDatagramSize is the default limit on the size of a UDP datagram read
+// by ReadUDPDatagram. It is the largest datagram RFC 1928 allows: a header
+// with a 255 byte domain name carrying a 65535 byte payload.
+var MaxUDPDatagramSize = 262 + 65535
+
+var defaultDecodeOptions = &DecodeOptions{}
+
+// udpBuffers holds the buffers readUDPDatagram reads into, so that reading a
+// datagram costs what it takes to keep it, not the size limit.
+var udpBuffers sync.Pool
+
+// frameBuffers holds the buffers readFrom reads requests into when they
+// need not outlive the call.
+var frameBuffers = sync.Pool{New: func() any { return new([262]byte) }}
+
+// getUDPBuffer returns a buffer from udpBuffers of at least size bytes.
+func getUDPBuffer(size int) *[]byte {
+	if p, ok := udpBuffers.Get().(*[]byte); ok && len(*p) >= size {
+		return p
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+// EncodeOptions tunes what the *WithOptions writers accept. The zero value,
+// also used by the plain Write methods, sends any value as is.
+type EncodeOptions struct {
+	// StrictReplyCode refuses to write a reply whose REP field is not one of
+	// the codes RFC 1928 defines, Succeeded to AddrUnsupported, with
+	// ErrBadReplyCode, to catch a bad mapping of errors to reply codes.
+	StrictReplyCode bool
+}
+
+// checkUDPHeader applies StrictRSV to the header of a UDP datagram.
+func (opts *DecodeOptions) checkUDPHeader(h *UDPHeader) error {
+	if opts.StrictRSV && (h.Rsv != 0 || h.Frag == 0x80) {
+		return ErrBadFormat
+	}
+	return nil
+}
+
+func (opts *DecodeOptions) checkAddr(addr *Addr) error {
+	if opts.RejectMappedIPv4 && addr.isMappedIPv4() {
+		return ErrBadAddrType
+	}
+	return nil
+}
+
+// FrameError is returned by the Read functions when a frame cannot be
+// decoded. Consumed is the number of bytes read from the input before the
+// error, so that a caller can tell a frame rejected on its first bytes from
+// one abandoned partway and decide whether the stream can be recovered.
+// From a reader other than a BufferedConn or *bufio.Reader, it may include
+// bytes past the frame. The Parse functions, which consume no stream, leave
+// it zero.
+type FrameError struct {
+	Op       string // the frame being decoded, e.g. "reading request"
+	Consumed int
+	Err      error
+}
+
+func (e *FrameError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// AddrLenError is the error of Addr.Decode for an address cut short, which
+// wraps ErrShortBuffer and tells which part is missing: the host, e.g. the 16
+// bytes of an IPv6 address, or the port.
+type AddrLenError struct {
+	Type uint8 // ATYP of the address
+	Port bool  // whether the host is whole and the port is short
+	Want int   // length of the part, counting a domain's length byte
+	Got  int   // bytes of it present
+}
+
+func (e *AddrLenError) Error() string {
+	part, unit := "", "bytes"
+	if e.Port {
+		part = " port"
+	}
+	if e.Want == 1 {
+		unit = "byte"
+	}
+	return fmt.Sprintf("address type %s requires %d%s %s, got %d", addrTypeName(e.Type), e.Want, part, unit, e.Got)
+}
+
+func (e *AddrLenError) Unwrap() error {
+	return ErrShortBuffer
+}
+
+func addrTypeName(t uint8) string {
+	switch t {
+	case AddrIPv4:
+		return "IPv4"
+	case AddrIPv6:
+		return "IPv6"
+	case AddrDomain:
+		return "domain"
+	case AddrUnix:
+		return "Unix"
+	}
+	return fmt.Sprintf("%#02x", t)
+}
+
+// wrapErr adds op to a decoding error as context, keeping the underlying
+// error available to errors.Is. io.EOF is returned as is, since callers
+// compare against it to detect a clean disconnect.
+func wrapErr(op string, n int, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &FrameError{Op: op, Consumed: n, Err: err}
+}
+
+// readRest fills b with the rest of a frame whose start has already been
+// read, so running out of input there is always io.ErrUnexpectedEOF.
+func readRest(r io.Reader, b []byte) (int, error) {
+	n, err := io.ReadFull(r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
 /*
 Method selection
 +----+----------+----------+
@@ -69,29 +276,57 @@ Method selection
 | 1  |    1     | 1 to 255 |
 +----+----------+----------+
 */
+
+// ReadMethods reads exactly one method selection frame, so that a frame the
+// client pipelined behind it, such as its username/password request, is
+// left unread in r. A frame opening with an ASCII letter, as a plain text
+// protocol such as HTTP ("GET ...") would, yields ErrNotSocks5 rather than
+// ErrBadVersion, to tell such probes apart from broken clients.
 func ReadMethods(r io.Reader) ([]uint8, error) {
+	methods, n, err := readMethods(r)
+	return methods, wrapErr("reading methods", n, err)
+}
+
+func readMethods(r io.Reader) ([]uint8, int, error) {
 	b := make([]byte, 257)
-	n, err := io.ReadAtLeast(r, b, 2)
+	n, err := io.ReadFull(r, b[:2])
 	if err != nil {
-		return nil, err
+		return nil, n, err
 	}
 
+	if c := b[0] | 0x20; 'a' <= c && c <= 'z' {
+		return nil, n, ErrNotSocks5
+	}
 	if b[0] != Ver5 {
-		return nil, ErrBadVersion
+		return nil, n, ErrBadVersion
 	}
 
 	if b[1] == 0 {
-		return nil, ErrBadMethod
+		return nil, n, ErrBadMethod
 	}
 
 	length := 2 + int(b[1])
-	if n < length {
-		if _, err := io.ReadFull(r, b[n:length]); err != nil {
-			return nil, err
-		}
+	m, err := readRest(r, b[2:length])
+	if err != nil {
+		return nil, n + m, err
 	}
 
-	return b[2:length], nil
+	return b[2:length], length, nil
+}
+
+// EncodeHandshake returns the method selection frame a client opens with,
+// offering methods, or only MethodNoAuth if there are none. At most 255
+// methods fit in the frame; any beyond are left out.
+func EncodeHandshake(methods []uint8) []byte {
+	if len(methods) == 0 {
+		methods = []uint8{MethodNoAuth}
+	}
+	if len(methods) > 255 {
+		methods = methods[:255]
+	}
+	b := make([]byte, 0, 2+len(methods))
+	b = append(b, Ver5, uint8(len(methods)))
+	return append(b, methods...)
 }
 
 func WriteMethod(method uint8, w io.Writer) error {
@@ -99,13 +334,37 @@ func WriteMethod(method uint8, w io.Writer) error {
 	return err
 }
 
+// ReadMethodSelection reads the server's VER | METHOD answer. A server that
+// accepts none of the offered methods yields ErrNoAcceptableMethod.
+func ReadMethodSelection(r io.Reader) (uint8, error) {
+	method, n, err := readMethodSelection(r)
+	return method, wrapErr("reading method selection", n, err)
+}
+
+func readMethodSelection(r io.Reader) (uint8, int, error) {
+	b := make([]byte, 2)
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return 0, n, err
+	}
+
+	if b[0] != Ver5 {
+		return 0, n, ErrBadVersion
+	}
+	if b[1] == MethodNoAcceptable {
+		return 0, n, ErrNoAcceptableMethod
+	}
+
+	return b[1], n, nil
+}
+
 /*
- Username/Password authentication request
- +----+------+----------+------+----------+
- |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
- +----+------+----------+------+----------+
- | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
- +----+------+----------+------+----------+
+Username/Password authentication request
++----+------+----------+------+----------+
+|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
++----+------+----------+------+----------+
+| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
++----+------+----------+------+----------+
 */
 type UserPassRequest struct {
 	Version  byte
@@ -121,52 +380,58 @@ func NewUserPassRequest(ver byte, u, p string) *UserPassRequest {
 	}
 }
 
+// ReadUserPassRequest reads exactly one username/password request, as
+// ReadMethods does the method selection, so that a request the client
+// pipelined behind it is left unread in r.
 func ReadUserPassRequest(r io.Reader) (*UserPassRequest, error) {
+	req, n, err := readUserPassRequest(r)
+	return req, wrapErr("reading userpass request", n, err)
+}
+
+func readUserPassRequest(r io.Reader) (*UserPassRequest, int, error) {
 	b := make([]byte, 513)
-	n, err := io.ReadAtLeast(r, b, 2)
+	length, err := readExactFrame(r, b, userPassLen)
 	if err != nil {
-		return nil, err
-	}
-
-	if b[0] != UserPassVer {
-		return nil, ErrBadVersion
+		return nil, length, err
 	}
 
+	ulen := int(b[1])
 	req := &UserPassRequest{
-		Version: b[0],
+		Version:  b[0],
+		Username: string(b[2 : 2+ulen]),
+		Password: string(b[3+ulen : length]),
 	}
+	return req, length, nil
+}
 
-	ulen := int(b[1])
-	length := ulen + 3
-
-	if n < length {
-		if _, err := io.ReadFull(r, b[n:length]); err != nil {
-			return nil, err
-		}
-		n = length
+// userPassLen is the frameLen of a username/password request.
+func userPassLen(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 2, nil
+	}
+	if b[0] != UserPassVer {
+		return 0, ErrBadVersion
 	}
-	req.Username = string(b[2 : 2+ulen])
 
-	plen := int(b[length-1])
-	length += plen
-	if n < length {
-		if _, err := io.ReadFull(r, b[n:length]); err != nil {
-			return nil, err
-		}
+	length := int(b[1]) + 3
+	if len(b) < length {
+		return length, nil
 	}
-	req.Password = string(b[3+ulen : length])
-	return req, nil
+	return length + int(b[length-1]), nil
 }
 
 func (req *UserPassRequest) Write(w io.Writer) error {
+	ulen, plen := len(req.Username), len(req.Password)
+	if ulen > 255 || plen > 255 {
+		return ErrBadFormat
+	}
+
 	b := make([]byte, 513)
 	b[0] = req.Version
-	ulen := len(req.Username)
 	b[1] = byte(ulen)
 	length := 2 + ulen
 	copy(b[2:length], req.Username)
 
-	plen := len(req.Password)
 	b[length] = byte(plen)
 	length++
 	copy(b[length:length+plen], req.Password)
@@ -177,12 +442,12 @@ func (req *UserPassRequest) Write(w io.Writer) error {
 }
 
 /*
- Username/Password authentication response
- +----+--------+
- |VER | STATUS |
- +----+--------+
- | 1  |   1    |
- +----+--------+
+Username/Password authentication response
++----+--------+
+|VER | STATUS |
++----+--------+
+| 1  |   1    |
++----+--------+
 */
 type UserPassResponse struct {
 	Version byte
@@ -197,13 +462,19 @@ func NewUserPassResponse(ver, status byte) *UserPassResponse {
 }
 
 func ReadUserPassResponse(r io.Reader) (*UserPassResponse, error) {
+	res, n, err := readUserPassResponse(r)
+	return res, wrapErr("reading userpass response", n, err)
+}
+
+func readUserPassResponse(r io.Reader) (*UserPassResponse, int, error) {
 	b := make([]byte, 2)
-	if _, err := io.ReadFull(r, b); err != nil {
-		return nil, err
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, n, err
 	}
 
 	if b[0] != UserPassVer {
-		return nil, ErrBadVersion
+		return nil, n, ErrBadVersion
 	}
 
 	res := &UserPassResponse{
@@ -211,7 +482,12 @@ func ReadUserPassResponse(r io.Reader) (*UserPassResponse, error) {
 		Status:  b[1],
 	}
 
-	return res, nil
+	return res, n, nil
+}
+
+// OK reports whether the response accepts the credentials.
+func (res *UserPassResponse) OK() bool {
+	return res.Status == AuthSuccess
 }
 
 func (res *UserPassResponse) Write(w io.Writer) error {
@@ -223,38 +499,133 @@ type Addr struct {
 	Type uint8
 	Host string
 	Port uint16
+	Zone string // IPv6 scope zone, not carried on the wire
 }
 
+// Decode decodes the address at the start of b. b may go on past the
+// address, in which case the extra bytes are ignored; one too short for the
+// address yields ErrShortBuffer, as an *AddrLenError unless it is empty or
+// of a registered type.
 func (addr *Addr) Decode(b []byte) error {
+	if len(b) < 1 {
+		return ErrShortBuffer
+	}
 	addr.Type = b[0]
 	pos := 1
+	short := func(want int) error {
+		return &AddrLenError{Type: addr.Type, Want: want, Got: len(b) - 1}
+	}
 	switch addr.Type {
 	case AddrIPv4:
+		if len(b) < pos+net.IPv4len {
+			return short(net.IPv4len)
+		}
 		addr.Host = net.IP(b[pos : pos+net.IPv4len]).String()
 		pos += net.IPv4len
 	case AddrIPv6:
+		if len(b) < pos+net.IPv6len {
+			return short(net.IPv6len)
+		}
 		addr.Host = net.IP(b[pos : pos+net.IPv6len]).String()
 		pos += net.IPv6len
+	case AddrUnix:
+		if !EnableUnixAddr {
+			return ErrBadAddrType
+		}
+		fallthrough
 	case AddrDomain:
+		if len(b) < pos+1 {
+			return short(1)
+		}
 		addrlen := int(b[pos])
+		if addrlen == 0 {
+			// an empty host name is never valid
+			return ErrBadFormat
+		}
 		pos++
+		if len(b) < pos+addrlen {
+			return short(1 + addrlen)
+		}
 		addr.Host = string(b[pos : pos+addrlen])
 		pos += addrlen
 	default:
-		return ErrBadAddrType
+		at, ok := addrTypes[addr.Type]
+		if !ok {
+			return ErrBadAddrType
+		}
+		host, n, err := at.decode(b[pos:])
+		if err != nil {
+			return err
+		}
+		pos += n
+		addr.Host = host
 	}
 
-	addr.Port = binary.BigEndian.Uint16(b[pos:])
+	if len(b) < pos+2 {
+		return &AddrLenError{Type: addr.Type, Port: true, Want: 2, Got: len(b) - pos}
+	}
+	addr.Port = binary.BigEndian.Uint16(b[pos : pos+2])
 
 	return nil
 }
 
+// DecodeFrom decodes the address at the start of b, which may be followed by
+// other data, and returns the number of bytes it occupied.
+func (addr *Addr) DecodeFrom(b []byte) (int, error) {
+	if len(b) < 1 {
+		return 0, ErrShortBuffer
+	}
+
+	length, err := addrLen(b[0], b[1:])
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < length {
+		return 0, ErrShortBuffer
+	}
+	if err := addr.Decode(b[:length]); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// addrLen returns the encoded length of an address of type atype, counting
+// ATYP | ADDR | PORT. b holds the bytes following ATYP and is consulted only
+// for the length byte of a domain name.
+func addrLen(atype uint8, b []byte) (int, error) {
+	switch atype {
+	case AddrIPv4:
+		return 1 + net.IPv4len + 2, nil
+	case AddrIPv6:
+		return 1 + net.IPv6len + 2, nil
+	case AddrUnix:
+		if !EnableUnixAddr {
+			break
+		}
+		fallthrough
+	case AddrDomain:
+		if len(b) < 1 {
+			return 0, ErrShortBuffer
+		}
+		return 1 + 1 + int(b[0]) + 2, nil
+	}
+	if at, ok := addrTypes[atype]; ok {
+		return at.len(b)
+	}
+	return 0, ErrBadAddrType
+}
+
 func (addr *Addr) Encode(b []byte) (int, error) {
 	b[0] = addr.Type
 	pos := 1
 	switch addr.Type {
 	case AddrIPv4:
 		pos += copy(b[pos:], net.ParseIP(addr.Host).To4())
+	case AddrUnix:
+		if !EnableUnixAddr {
+			return 0, ErrBadAddrType
+		}
+		fallthrough
 	case AddrDomain:
 		b[pos] = byte(len(addr.Host))
 		pos++
@@ -262,8 +633,17 @@ func (addr *Addr) Encode(b []byte) (int, error) {
 	case AddrIPv6:
 		pos += copy(b[pos:], net.ParseIP(addr.Host).To16())
 	default:
-		b[0] = AddrIPv4
-		pos += 4
+		at, ok := addrTypes[addr.Type]
+		if !ok {
+			b[0] = AddrIPv4
+			pos += 4
+			break
+		}
+		n, err := at.encode(addr.Host, b[pos:])
+		if err != nil {
+			return 0, err
+		}
+		pos += n
 	}
 	binary.BigEndian.PutUint16(b[pos:], addr.Port)
 	pos += 2
@@ -271,8 +651,84 @@ func (addr *Addr) Encode(b []byte) (int, error) {
 	return pos, nil
 }
 
+// String returns addr as host:port, with an IPv6 host and its zone in
+// brackets, "[::1]:80", so that it can be fed back to net.Dial or ParseAddr.
+// Request.String, Reply.String and UDPHeader.String, and the conversions to
+// net addresses, go through it. An AddrUnix address is its path.
 func (addr *Addr) String() string {
-	return net.JoinHostPort(addr.Host, strconv.Itoa(int(addr.Port)))
+	if addr.Type == AddrUnix {
+		return addr.Host
+	}
+	host := addr.Host
+	if addr.Zone != "" {
+		host += "%" + addr.Zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(addr.Port)))
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, returning the wire form
+// ATYP | ADDR | PORT.
+func (addr *Addr) MarshalBinary() ([]byte, error) {
+	return addr.AppendBinary(nil)
+}
+
+// AppendBinary appends the wire form of addr to dst. Unlike Encode it
+// reports a host that does not fit the address type as ErrBadFormat.
+func (addr *Addr) AppendBinary(dst []byte) ([]byte, error) {
+	switch addr.Type {
+	case AddrIPv4:
+		ip := net.ParseIP(addr.Host).To4()
+		if ip == nil {
+			return dst, ErrBadFormat
+		}
+		dst = append(dst, AddrIPv4)
+		dst = append(dst, ip...)
+	case AddrUnix:
+		if !EnableUnixAddr {
+			return dst, ErrBadAddrType
+		}
+		fallthrough
+	case AddrDomain:
+		if len(addr.Host) == 0 || len(addr.Host) > 255 {
+			return dst, ErrBadFormat
+		}
+		dst = append(dst, addr.Type, byte(len(addr.Host)))
+		dst = append(dst, addr.Host...)
+	case AddrIPv6:
+		ip := net.ParseIP(addr.Host).To16()
+		if ip == nil {
+			return dst, ErrBadFormat
+		}
+		dst = append(dst, AddrIPv6)
+		dst = append(dst, ip...)
+	default:
+		at, ok := addrTypes[addr.Type]
+		if !ok {
+			dst = append(dst, AddrIPv4, 0, 0, 0, 0)
+			break
+		}
+		var b [maxCustomAddrLen]byte
+		n, err := at.encode(addr.Host, b[:])
+		if err != nil {
+			return dst, err
+		}
+		dst = append(dst, addr.Type)
+		dst = append(dst, b[:n]...)
+	}
+	return binary.BigEndian.AppendUint16(dst, addr.Port), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. b must hold exactly
+// one encoded address.
+func (addr *Addr) UnmarshalBinary(b []byte) error {
+	n, err := addr.DecodeFrom(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return ErrBadFormat
+	}
+	return nil
 }
 
 /*
@@ -283,6 +739,8 @@ The SOCKSv5 request
 | 1  |  1  | X'00' |  1   | Variable |    2     |
 +----+-----+-------+------+----------+----------+
 */
+// For a BIND, Addr is the address the client expects the inbound connection
+// from, which may be a domain name; it is kept as sent, unresolved.
 type Request struct {
 	Cmd  uint8
 	Addr *Addr
@@ -296,64 +754,210 @@ func NewRequest(cmd uint8, addr *Addr) *Request {
 }
 
 func ReadRequest(r io.Reader) (*Request, error) {
-	b := make([]byte, 262)
-	n, err := io.ReadAtLeast(r, b, 5)
+	return ReadRequestWithOptions(r, nil)
+}
+
+func ReadRequestWithOptions(r io.Reader, opts *DecodeOptions) (*Request, error) {
+	req, n, err := readRequest(r, opts)
+	return req, wrapErr("reading request", n, err)
+}
+
+func readRequest(r io.Reader, opts *DecodeOptions) (*Request, int, error) {
+	req := new(Request)
+	n, err := req.readFrom(r, opts, nil)
 	if err != nil {
-		return nil, err
+		return nil, n, err
 	}
+	return req, n, nil
+}
 
-	if b[0] != Ver5 {
-		return nil, ErrBadVersion
+// ReadRequestRaw is like ReadRequest, but also returns the bytes of the
+// frame exactly as read, e.g. for an audit log, which writing the Request
+// back out need not reproduce. Only this variant pays for keeping them.
+func ReadRequestRaw(r io.Reader) (*Request, []byte, error) {
+	req := new(Request)
+	var raw []byte
+	n, err := req.readFrom(r, nil, &raw)
+	if err != nil {
+		return nil, nil, wrapErr("reading request", n, err)
 	}
+	return req, raw, nil
+}
 
-	request := &Request{
-		Cmd: b[1],
-	}
+// ReadFrom reads a request from rd into r, as ReadRequest does, and returns
+// the number of bytes read. It reuses r and the Addr it points to, if any,
+// so that a server can keep Requests in a sync.Pool rather than allocate
+// them for every connection; only the new Host string is allocated, from
+// any reader, as the frame is read into a pooled buffer. Anyone
+// still holding r.Addr from the previous request sees it overwritten, so
+// copy the Addr, not the pointer, to keep it. Host itself never aliases the
+// read buffer. On error, the contents of r are undefined.
+func (r *Request) ReadFrom(rd io.Reader) (int64, error) {
+	n, err := r.readFrom(rd, nil, nil)
+	return int64(n), wrapErr("reading request", n, err)
+}
 
-	atype := b[3]
-	length := 0
-	switch atype {
-	case AddrIPv4:
-		length = 10
-	case AddrIPv6:
-		length = 22
-	case AddrDomain:
-		length = 7 + int(b[4])
-	default:
-		return nil, ErrBadAddrType
+// readFrom reads a request into r. If raw is set, it gets the frame read.
+func (r *Request) readFrom(rd io.Reader, opts *DecodeOptions, raw *[]byte) (int, error) {
+	if opts == nil {
+		opts = defaultDecodeOptions
+	}
+	if r.Addr == nil {
+		r.Addr = new(Addr)
 	}
 
-	if n < length {
-		if _, err := io.ReadFull(r, b[n:length]); err != nil {
-			return nil, err
+	if br, ok := bufferedReader(rd); ok && raw == nil {
+		if n, ok, err := r.readIPv4(br, opts); ok {
+			return n, err
 		}
 	}
-	addr := new(Addr)
-	if err := addr.Decode(b[3:length]); err != nil {
-		return nil, err
+
+	frameLen := cmdFrameLen
+	if opts.QuirkMode {
+		frameLen = quirkRequestLen
+	}
+	var b []byte
+	if raw == nil {
+		fb := frameBuffers.Get().(*[262]byte)
+		defer frameBuffers.Put(fb)
+		b = fb[:]
+	} else {
+		b = make([]byte, 262)
+	}
+	length, err := readFrame(rd, b, frameLen)
+	if err != nil {
+		return length, err
+	}
+
+	pos := 3
+	if opts.QuirkMode && missingRSV(b[:length]) {
+		pos = 2
+	} else if opts.StrictRSV && b[2] != 0 {
+		return length, ErrBadFormat
 	}
-	request.Addr = addr
 
-	return request, nil
+	r.Cmd = b[1]
+	*r.Addr = Addr{}
+	if err := r.Addr.Decode(b[pos:length]); err != nil {
+		return length, err
+	}
+	if err := opts.checkAddr(r.Addr); err != nil {
+		return length, err
+	}
+	if raw != nil {
+		*raw = b[:length:length]
+	}
+
+	return length, nil
 }
 
-func (r *Request) Write(w io.Writer) (err error) {
-	b := make([]byte, 262)
+// EncodeRequest returns the request frame for cmd and addr, as
+// NewRequest(cmd, addr).Write would send it.
+func EncodeRequest(cmd uint8, addr *Addr) ([]byte, error) {
+	return NewRequest(cmd, addr).MarshalBinary()
+}
+
+// readIPv4 is the fast path of readFrom for the most common request, one
+// for an IPv4 address, once it is buffered in full: it is decoded in place,
+// with the same result as the general path. ok is false if br holds
+// anything else, in which case nothing is consumed.
+func (r *Request) readIPv4(br *bufio.Reader, opts *DecodeOptions) (n int, ok bool, err error) {
+	// wait for the first bytes, as the general path would
+	if _, err := br.Peek(1); err != nil {
+		return 0, true, err
+	}
+	if br.Buffered() < 10 {
+		return 0, false, nil
+	}
+	b, _ := br.Peek(10)
+	if b[0] != Ver5 || b[3] != AddrIPv4 {
+		return 0, false, nil
+	}
+
+	r.Cmd = b[1]
+	*r.Addr = Addr{
+		Type: AddrIPv4,
+		Host: net.IP(b[4:8]).String(),
+		Port: binary.BigEndian.Uint16(b[8:10]),
+	}
+	rsv := b[2]
+	br.Discard(10)
 
-	b[0] = Ver5
-	b[1] = r.Cmd
-	// b[2] = 0 //rsv
-	b[3] = AddrIPv4 // default
+	if opts.StrictRSV && rsv != 0 {
+		return 10, true, ErrBadFormat
+	}
+	if err := opts.checkAddr(r.Addr); err != nil {
+		return 10, true, err
+	}
+	return 10, true, nil
+}
 
-	length := 10
-	if r.Addr != nil {
-		n, _ := r.Addr.Encode(b[3:])
-		length = 3 + n
+func (r *Request) Write(w io.Writer) (err error) {
+	b, err := r.AppendBinary(make([]byte, 0, 262))
+	if err != nil {
+		return
 	}
-	_, err = w.Write(b[:length])
+	_, err = w.Write(b)
 	return
 }
 
+// AppendBinary appends the wire form of r to dst, so that a buffer can be
+// reused across frames. Only a UDP ASSOCIATE may leave Addr nil, which is
+// sent as IPv4 0.0.0.0:0 for a client that does not know the address it will
+// send from; for other commands a nil Addr is likely a bug and yields
+// ErrBadFormat rather than a request for 0.0.0.0.
+func (r *Request) AppendBinary(dst []byte) ([]byte, error) {
+	if r.Addr == nil && r.Cmd != CmdUdp {
+		return dst, ErrBadFormat
+	}
+
+	dst = append(dst, Ver5, r.Cmd, 0)
+	if r.Addr == nil {
+		return append(dst, AddrIPv4, 0, 0, 0, 0, 0, 0), nil
+	}
+	return r.Addr.AppendBinary(dst)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, returning the same bytes
+// Write would send.
+func (r *Request) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(nil)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. b must hold exactly
+// one request frame.
+func (r *Request) UnmarshalBinary(b []byte) error {
+	if len(b) < 5 {
+		return ErrShortBuffer
+	}
+	if b[0] != Ver5 {
+		return ErrBadVersion
+	}
+
+	addr := new(Addr)
+	if err := addr.UnmarshalBinary(b[3:]); err != nil {
+		return err
+	}
+	r.Cmd = b[1]
+	r.Addr = addr
+
+	return nil
+}
+
+// Clone returns a copy of r with its own Addr, so that either can be
+// changed without affecting the other.
+func (r *Request) Clone() *Request {
+	return &Request{Cmd: r.Cmd, Addr: cloneAddr(r.Addr)}
+}
+
+func cloneAddr(addr *Addr) *Addr {
+	if addr == nil {
+		return nil
+	}
+	clone := *addr
+	return &clone
+}
+
 func (r *Request) String() string {
 	return fmt.Sprintf("5 %d 0 %d %s",
 		r.Cmd, r.Addr.Type, r.Addr.String())
@@ -379,67 +983,257 @@ func NewReply(rep uint8, addr *Addr) *Reply {
 	}
 }
 
-func ReadReply(r io.Reader) (*Reply, error) {
-	b := make([]byte, 262)
-	n, err := io.ReadAtLeast(r, b, 5)
+// NewReplyFromError returns a reply whose code is ReplyCodeForError(err).
+func NewReplyFromError(err error, addr *Addr) *Reply {
+	return NewReply(ReplyCodeForError(err), addr)
+}
+
+// WriteReplyFromConn writes a reply with code rep whose BND.ADDR is the
+// local address of outbound, the connection the server made to the target,
+// rather than the address the client asked for.
+func WriteReplyFromConn(w io.Writer, rep uint8, outbound net.Conn) error {
+	addr, err := NewAddrFromNetAddr(outbound.LocalAddr())
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return NewReply(rep, addr).Write(w)
+}
 
-	if b[0] != Ver5 {
-		return nil, ErrBadVersion
+// NewUDPAssociateReply returns the Succeeded reply to a UDP ASSOCIATE whose
+// BND.ADDR is relay, the local address of the socket that relays the
+// client's datagrams, not the address of the client or of the control
+// connection. relay must be a *net.UDPAddr, or ErrBadAddrType is returned.
+func NewUDPAssociateReply(relay net.Addr) (*Reply, error) {
+	if _, ok := relay.(*net.UDPAddr); !ok {
+		return nil, ErrBadAddrType
 	}
+	addr, err := NewAddrFromNetAddr(relay)
+	if err != nil {
+		return nil, err
+	}
+	return NewReply(Succeeded, addr), nil
+}
 
-	reply := &Reply{
-		Rep: b[1],
+func ReadReply(r io.Reader) (*Reply, error) {
+	return ReadReplyWithOptions(r, nil)
+}
+
+func ReadReplyWithOptions(r io.Reader, opts *DecodeOptions) (*Reply, error) {
+	rep, n, err := readReply(r, opts, nil)
+	return rep, wrapErr("reading reply", n, err)
+}
+
+// ReadReplyRaw is like ReadReply, but also returns the bytes of the frame
+// exactly as read, as ReadRequestRaw does.
+func ReadReplyRaw(r io.Reader) (*Reply, []byte, error) {
+	var raw []byte
+	rep, n, err := readReply(r, nil, &raw)
+	if err != nil {
+		return nil, nil, wrapErr("reading reply", n, err)
 	}
+	return rep, raw, nil
+}
 
-	atype := b[3]
-	length := 0
-	switch atype {
-	case AddrIPv4:
-		length = 10
-	case AddrIPv6:
-		length = 22
-	case AddrDomain:
-		length = 7 + int(b[4])
-	default:
-		return nil, ErrBadAddrType
+// readReply reads a reply. If raw is set, it gets the frame read.
+func readReply(r io.Reader, opts *DecodeOptions, raw *[]byte) (*Reply, int, error) {
+	if opts == nil {
+		opts = defaultDecodeOptions
 	}
 
-	if n < length {
-		if _, err := io.ReadFull(r, b[n:length]); err != nil {
-			return nil, err
+	b := make([]byte, 262)
+	frameLen := cmdFrameLen
+	if opts.LenientReplyAddr {
+		frameLen = lenientReplyLen
+	}
+	length, err := readFrame(r, b, frameLen)
+	if raw != nil {
+		*raw = b[:length:length]
+	}
+	if opts.LenientReplyAddr {
+		if err == io.ErrUnexpectedEOF && b[0] != Ver5 {
+			return nil, length, ErrBadVersion
+		}
+		if err == nil && length == 4 || err == io.ErrUnexpectedEOF && length >= 3 && b[1] == Succeeded {
+			return &Reply{Rep: b[1], Addr: &Addr{Type: AddrIPv4, Host: "0.0.0.0"}}, length, nil
 		}
 	}
+	if err != nil {
+		return nil, length, err
+	}
+
+	if opts.StrictRSV && b[2] != 0 {
+		return nil, length, ErrBadFormat
+	}
+	if opts.StrictReplyCode && b[1] > AddrUnsupported {
+		return nil, length, ErrBadReplyCode
+	}
+
+	reply := &Reply{
+		Rep: b[1],
+	}
 
 	addr := new(Addr)
 	if err := addr.Decode(b[3:length]); err != nil {
-		return nil, err
+		return nil, length, err
+	}
+	if err := opts.checkAddr(addr); err != nil {
+		return nil, length, err
 	}
 	reply.Addr = addr
 
-	return reply, nil
+	return reply, length, nil
 }
 
-func (r *Reply) Write(w io.Writer) (err error) {
-	b := make([]byte, 262)
+// cmdFrameLen is the frameLen of a request or reply, which share the
+// VER | CMD/REP | RSV | ATYP | ADDR | PORT layout.
+func cmdFrameLen(b []byte) (int, error) {
+	if len(b) < 5 {
+		return 5, nil
+	}
+	if b[0] != Ver5 {
+		return 0, ErrBadVersion
+	}
 
-	b[0] = Ver5
-	b[1] = r.Rep
-	// b[2] = 0 //rsv
-	b[3] = AddrIPv4 // default
+	length, err := addrLen(b[3], b[4:])
+	if err != nil {
+		return 0, err
+	}
+	return 3 + length, nil
+}
+
+// quirkRequestLen is the frameLen of a request under QuirkMode, which may
+// lack RSV.
+func quirkRequestLen(b []byte) (int, error) {
+	if len(b) >= 1 && b[0] != Ver5 {
+		return 0, ErrBadVersion
+	}
+	if len(b) < 4 {
+		return 4, nil
+	}
+	if !missingRSV(b) {
+		return cmdFrameLen(b)
+	}
+	length, err := addrLen(b[2], b[3:])
+	if err != nil {
+		return 0, err
+	}
+	return 2 + length, nil
+}
+
+// missingRSV reports whether the request starting with b, of at least 4
+// bytes, is taken to lack RSV under QuirkMode.
+func missingRSV(b []byte) bool {
+	switch b[2] {
+	case AddrIPv4, AddrDomain, AddrIPv6:
+		return !knownAddrType(b[3])
+	}
+	return false
+}
+
+func knownAddrType(t uint8) bool {
+	switch t {
+	case AddrIPv4, AddrDomain, AddrIPv6:
+		return true
+	case AddrUnix:
+		return EnableUnixAddr
+	}
+	_, ok := addrTypes[t]
+	return ok
+}
+
+// lenientReplyLen is the frameLen of a reply under LenientReplyAddr, where
+// ATYP 0 ends the frame.
+func lenientReplyLen(b []byte) (int, error) {
+	if len(b) >= 1 && b[0] != Ver5 {
+		return 0, ErrBadVersion
+	}
+	if len(b) < 4 {
+		return 4, nil
+	}
+	if b[3] == 0 {
+		return 4, nil
+	}
+	return cmdFrameLen(b)
+}
+
+func (r *Reply) Write(w io.Writer) (err error) {
+	return r.WriteWithOptions(w, nil)
+}
 
-	length := 10
-	if r.Addr != nil {
-		n, _ := r.Addr.Encode(b[3:])
-		length = 3 + n
+func (r *Reply) WriteWithOptions(w io.Writer, opts *EncodeOptions) (err error) {
+	if opts != nil && opts.StrictReplyCode && r.Rep > AddrUnsupported {
+		return ErrBadReplyCode
 	}
-	_, err = w.Write(b[:length])
 
+	b, err := r.AppendBinary(make([]byte, 0, 262))
+	if err != nil {
+		return
+	}
+	_, err = w.Write(b)
 	return
 }
 
+// AppendBinary appends the wire form of r to dst, so that a buffer can be
+// reused across frames. A nil Addr is sent as IPv4 0.0.0.0:0.
+func (r *Reply) AppendBinary(dst []byte) ([]byte, error) {
+	dst = append(dst, Ver5, r.Rep, 0)
+	if r.Addr == nil {
+		return append(dst, AddrIPv4, 0, 0, 0, 0, 0, 0), nil
+	}
+	return r.Addr.AppendBinary(dst)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, returning the same bytes
+// Write would send.
+func (r *Reply) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(nil)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. b must hold exactly
+// one reply frame.
+func (r *Reply) UnmarshalBinary(b []byte) error {
+	if len(b) < 5 {
+		return ErrShortBuffer
+	}
+	if b[0] != Ver5 {
+		return ErrBadVersion
+	}
+
+	addr := new(Addr)
+	if err := addr.UnmarshalBinary(b[3:]); err != nil {
+		return err
+	}
+	r.Rep = b[1]
+	r.Addr = addr
+
+	return nil
+}
+
+// Succeeded reports whether the reply grants the request.
+func (r *Reply) Succeeded() bool {
+	return r.Rep == Succeeded
+}
+
+// BindPort returns BND.PORT, the port a BIND is listening on. Zero, which
+// some servers send to mean the port of the control connection to the
+// server, is returned as is; so is zero for a nil Addr.
+func (r *Reply) BindPort() uint16 {
+	if r.Addr == nil {
+		return 0
+	}
+	return r.Addr.Port
+}
+
+// IsFailure reports whether the reply refuses the request, for any reason.
+func (r *Reply) IsFailure() bool {
+	return r.Rep != Succeeded
+}
+
+// Clone returns a copy of r with its own Addr, as Request.Clone does.
+func (r *Reply) Clone() *Reply {
+	return &Reply{Rep: r.Rep, Addr: cloneAddr(r.Addr)}
+}
+
 func (r *Reply) String() string {
 	return fmt.Sprintf("5 %d 0 %d %s",
 		r.Rep, r.Addr.Type, r.Addr.String())
@@ -484,76 +1278,245 @@ func NewUDPDatagram(header *UDPHeader, data []byte) *UDPDatagram {
 	}
 }
 
+// ReadUDPDatagram reads a datagram of at most MaxUDPDatagramSize bytes; a
+// larger one yields ErrShortBuffer. With the length of its payload in RSV,
+// as when tunnelling UDP over TCP, it reads exactly one datagram from a
+// BufferedConn or *bufio.Reader, leaving those behind it on the stream.
 func ReadUDPDatagram(r io.Reader) (*UDPDatagram, error) {
-	b := make([]byte, 65797)
-	n, err := io.ReadAtLeast(r, b, 5)
+	return ReadUDPDatagramWithOptions(r, nil)
+}
+
+// ReadUDPDatagramWithOptions is like ReadUDPDatagram. Note that StrictRSV
+// rejects the RSV-as-length framing used when tunnelling UDP over TCP.
+func ReadUDPDatagramWithOptions(r io.Reader, opts *DecodeOptions) (*UDPDatagram, error) {
+	d, n, err := readUDPDatagram(r, opts)
+	return d, wrapErr("reading UDP datagram", n, err)
+}
+
+func readUDPDatagram(r io.Reader, opts *DecodeOptions) (*UDPDatagram, int, error) {
+	if opts == nil {
+		opts = defaultDecodeOptions
+	}
+
+	size := opts.MaxUDPDatagramSize
+	if size == 0 {
+		size = MaxUDPDatagramSize
+	}
+	if size < 5 {
+		return nil, 0, ErrShortBuffer
+	}
+
+	// one spare byte to tell a datagram that fills the limit from one
+	// truncated by it
+	buf := getUDPBuffer(size + 1)
+	defer udpBuffers.Put(buf)
+	b := (*buf)[:size+1]
+	n, err := readUDPHeader(r, b)
 	if err != nil {
-		return nil, err
+		return nil, n, err
 	}
 
 	header := &UDPHeader{
 		Rsv:  binary.BigEndian.Uint16(b[:2]),
 		Frag: b[2],
 	}
+	if err := opts.checkUDPHeader(header); err != nil {
+		return nil, n, err
+	}
 
-	atype := b[3]
-	hlen := 0
-	switch atype {
-	case AddrIPv4:
-		hlen = 10
-	case AddrIPv6:
-		hlen = 22
-	case AddrDomain:
-		hlen = 7 + int(b[4])
-	default:
-		return nil, ErrBadAddrType
+	alen, err := addrLen(b[3], b[4:n])
+	if err != nil {
+		return nil, n, err
 	}
+	hlen := 3 + alen
 
 	dlen := int(header.Rsv)
+	if hlen+dlen > size || (dlen == 0 && n > size) {
+		return nil, n, ErrShortBuffer
+	}
+	end := n
+	if dlen > 0 {
+		// a short read may have taken in more than the datagram
+		end = hlen + dlen
+	}
 	if n < hlen+dlen {
-		if _, err := io.ReadFull(r, b[n:hlen+dlen]); err != nil {
-			return nil, err
+		m, err := readRest(r, b[n:hlen+dlen])
+		if err != nil {
+			return nil, n + m, err
 		}
 		n = hlen + dlen
 	}
 
 	header.Addr = new(Addr)
 	if err := header.Addr.Decode(b[3:hlen]); err != nil {
-		return nil, err
+		return nil, n, err
+	}
+	if err := opts.checkAddr(header.Addr); err != nil {
+		return nil, n, err
 	}
 
 	d := &UDPDatagram{
 		Header: header,
-		Data:   b[hlen:n],
+		Data:   append([]byte(nil), b[hlen:end]...),
 	}
 
-	return d, nil
+	return d, n, nil
+}
+
+// readUDPHeader reads at least the header of a datagram into b. A buffered
+// reader is read exactly, up to the end of the header, and then, with no
+// length in RSV, for what it already holds as the payload, so that datagrams
+// following on a stream are left unread. Others are read at least 5 bytes.
+func readUDPHeader(r io.Reader, b []byte) (int, error) {
+	br, ok := bufferedReader(r)
+	if !ok {
+		return io.ReadAtLeast(r, b, 5)
+	}
+
+	n, err := readFrameFrom(br, b, udpHeaderLen, true)
+	if err != nil || binary.BigEndian.Uint16(b[:2]) != 0 {
+		return n, err
+	}
+	if m := min(br.Buffered(), len(b)-n); m > 0 {
+		m, _ = br.Read(b[n : n+m])
+		n += m
+	}
+	return n, nil
+}
+
+// udpHeaderLen is the frameLen of the header of a UDP datagram.
+func udpHeaderLen(b []byte) (int, error) {
+	if len(b) < 5 {
+		return 5, nil
+	}
+	alen, err := addrLen(b[3], b[4:])
+	if err != nil {
+		return 0, err
+	}
+	return 3 + alen, nil
+}
+
+// ParseUDPDatagram parses a datagram received on a UDP relay socket, where
+// b holds exactly one packet: everything after the header is the payload,
+// whatever RSV says. Data aliases b. A header cut short by the end of b
+// yields ErrShortBuffer.
+func ParseUDPDatagram(b []byte) (*UDPDatagram, error) {
+	return ParseUDPDatagramWithOptions(b, nil)
+}
+
+// ParseUDPDatagramWithOptions is like ParseUDPDatagram. Since RSV carries
+// no length on a relay socket, StrictRSV is the check to make there against
+// corrupted or forged datagrams.
+func ParseUDPDatagramWithOptions(b []byte, opts *DecodeOptions) (*UDPDatagram, error) {
+	d, err := parseUDPDatagram(b, opts)
+	return d, wrapErr("parsing UDP datagram", 0, err)
+}
+
+func parseUDPDatagram(b []byte, opts *DecodeOptions) (*UDPDatagram, error) {
+	if opts == nil {
+		opts = defaultDecodeOptions
+	}
+	if len(b) < 4 {
+		return nil, ErrShortBuffer
+	}
+
+	header := &UDPHeader{
+		Rsv:  binary.BigEndian.Uint16(b[:2]),
+		Frag: b[2],
+		Addr: new(Addr),
+	}
+	if err := opts.checkUDPHeader(header); err != nil {
+		return nil, err
+	}
+	n, err := header.Addr.DecodeFrom(b[3:])
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkAddr(header.Addr); err != nil {
+		return nil, err
+	}
+
+	return &UDPDatagram{
+		Header: header,
+		Data:   b[3+n:],
+	}, nil
 }
 
 func (d *UDPDatagram) Write(w io.Writer) error {
-	buffer := &bytes.Buffer{}
+	b, err := d.AppendBinary(make([]byte, 0, 262+len(d.Data)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
 
-	b := make([]byte, 259)
+// AppendBinary appends the wire form of d to dst, so that a relay can reuse
+// one buffer across datagrams. A nil Header, or a nil Header.Addr, is sent
+// as IPv4 0.0.0.0:0.
+func (d *UDPDatagram) AppendBinary(dst []byte) ([]byte, error) {
+	var header UDPHeader
 	if d.Header != nil {
-		binary.BigEndian.PutUint16(b[:2], d.Header.Rsv)
-		buffer.Write(b[:2])
-		buffer.WriteByte(d.Header.Frag)
+		header = *d.Header
+	}
 
-		b[0] = AddrIPv4
-		b[1] = 0
-		length := 7
+	dst = binary.BigEndian.AppendUint16(dst, header.Rsv)
+	dst = append(dst, header.Frag)
+	if header.Addr == nil {
+		dst = append(dst, AddrIPv4, 0, 0, 0, 0, 0, 0)
+	} else {
+		var err error
+		if dst, err = header.Addr.AppendBinary(dst); err != nil {
+			return dst, err
+		}
+	}
+	return append(dst, d.Data...), nil
+}
+
+// AppendUDPDatagrams appends the wire form of each of ds to dst in turn, as
+// AppendBinary would, growing dst once for the whole burst rather than per
+// datagram. Each datagram is framed on its own and nothing marks where one
+// ends, so the result is not one UDP packet: a relay sending each datagram
+// as its own packet wants the boundaries, and should call AppendBinary per
+// datagram on a reused buffer instead. The result suits a stream carrying
+// the frames back to back with Header.Rsv holding the length of each
+// payload, as when tunnelling UDP over TCP, read back one datagram at a time
+// by ReadUDPDatagram from a BufferedConn or *bufio.Reader. On error, dst is returned with
+// the datagrams before the failing one.
+func AppendUDPDatagrams(dst []byte, ds []*UDPDatagram) ([]byte, error) {
+	n := 0
+	for _, d := range ds {
+		n += udpFrameLen(d)
+	}
+	dst = slices.Grow(dst, n)
 
-		if d.Header.Addr != nil {
-			length, _ = d.Header.Addr.Encode(b)
+	for _, d := range ds {
+		b, err := d.AppendBinary(dst)
+		if err != nil {
+			return dst, err
 		}
-		buffer.Write(b[:length])
-	} else {
-		b[3] = AddrIPv4
-		buffer.Write(b[:10])
+		dst = b
 	}
+	return dst, nil
+}
 
-	buffer.Write(d.Data)
-	_, err := w.Write(buffer.Bytes())
+// udpFrameLen estimates the wire length of d, exactly for the built-in
+// address types.
+func udpFrameLen(d *UDPDatagram) int {
+	alen := 7
+	if d.Header != nil && d.Header.Addr != nil {
+		switch d.Header.Addr.Type {
+		case AddrDomain:
+			alen = 4 + len(d.Header.Addr.Host)
+		case AddrIPv6:
+			alen = 19
+		}
+	}
+	return 3 + alen + len(d.Data)
+}
 
-	return err
+// MarshalBinary implements encoding.BinaryMarshaler, returning the same bytes
+// Write would send.
+func (d *UDPDatagram) MarshalBinary() ([]byte, error) {
+	return d.AppendBinary(nil)
 }
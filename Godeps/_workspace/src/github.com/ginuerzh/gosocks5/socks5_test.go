@@ -0,0 +1,1001 @@
+package gosocks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/ginuerzh/gosocks5/gosocks5test"
+)
+
+var benchRequest = NewRequest(CmdConnect, &Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 443})
+
+func BenchmarkRequestWrite(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := benchRequest.Write(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRequestAppendBinary(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]byte, 0, 262)
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = benchRequest.AppendBinary(buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Discard.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadRequest reads an IPv4 CONNECT from a buffered reader, which
+// takes the fast path, and from the same reader hidden behind a plain
+// io.Reader, which takes the general one.
+func BenchmarkReadRequest(b *testing.B) {
+	frame, err := benchRequest.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, fast := range []bool{true, false} {
+		name := "fast"
+		if !fast {
+			name = "general"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			src := bytes.NewReader(frame)
+			br := bufio.NewReader(src)
+			var r io.Reader = br
+			if !fast {
+				r = struct{ io.Reader }{br}
+			}
+			for i := 0; i < b.N; i++ {
+				src.Reset(frame)
+				br.Reset(src)
+				if _, err := ReadRequest(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRequestReadFrom is BenchmarkReadRequest decoding into one reused
+// Request instead.
+func BenchmarkRequestReadFrom(b *testing.B) {
+	frame, err := benchRequest.MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, fast := range []bool{true, false} {
+		name := "fast"
+		if !fast {
+			name = "general"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			src := bytes.NewReader(frame)
+			br := bufio.NewReader(src)
+			var r io.Reader = br
+			if !fast {
+				r = struct{ io.Reader }{br}
+			}
+			var req Request
+			for i := 0; i < b.N; i++ {
+				src.Reset(frame)
+				br.Reset(src)
+				if _, err := req.ReadFrom(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestReadFromAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool does not keep buffers under the race detector")
+	}
+	frame, err := NewRequest(CmdConnect, &Addr{Type: AddrDomain, Host: "example.com", Port: 80}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := bytes.NewReader(frame)
+	var req Request
+	// unbuffered, so the general path; only Host is allocated
+	n := testing.AllocsPerRun(100, func() {
+		src.Reset(frame)
+		if _, err := req.ReadFrom(src); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if n != 1 {
+		t.Errorf("ReadFrom: %v allocs, want 1", n)
+	}
+}
+
+func TestRequestReadFrom(t *testing.T) {
+	reqs := []*Request{
+		NewRequest(CmdConnect, &Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 443}),
+		NewRequest(CmdUdp, &Addr{Type: AddrDomain, Host: "example.com", Port: 53}),
+		NewRequest(CmdBind, &Addr{Type: AddrIPv6, Host: "2001:db8::1", Port: 80}),
+		NewRequest(CmdConnect, &Addr{Type: AddrIPv4, Host: "198.51.100.7", Port: 8080}),
+	}
+
+	var buf bytes.Buffer
+	for _, req := range reqs {
+		if err := req.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames := buf.Len()
+
+	var got Request
+	var addr *Addr
+	var total int64
+	br := bufio.NewReader(&buf)
+	for i, want := range reqs {
+		n, err := got.ReadFrom(br)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		total += n
+		if got.Cmd != want.Cmd || *got.Addr != *want.Addr {
+			t.Errorf("request %d: got %v, want %v", i, &got, want)
+		}
+		if addr == nil {
+			addr = got.Addr
+		} else if got.Addr != addr {
+			t.Errorf("request %d: Addr was not reused", i)
+		}
+	}
+	if total != int64(frames) {
+		t.Errorf("read %d bytes, want %d", total, frames)
+	}
+
+	if _, err := got.ReadFrom(br); err != io.EOF {
+		t.Errorf("ReadFrom at EOF: got %v, want io.EOF", err)
+	}
+}
+
+func TestReadRequestQuirkMode(t *testing.T) {
+	ipv6 := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	tests := []struct {
+		name  string
+		frame []byte
+		want  string
+		err   error // under StrictRSV as well
+	}{
+		{"IPv4 without RSV", []byte{Ver5, CmdConnect, AddrIPv4, 192, 0, 2, 1, 0, 80}, "192.0.2.1:80", nil},
+		{"domain without RSV", append(append([]byte{Ver5, CmdConnect, AddrDomain, 11}, "example.com"...), 0, 80), "example.com:80", nil},
+		{"IPv6 without RSV", append(append([]byte{Ver5, CmdConnect, AddrIPv6}, ipv6...), 0, 80), "[2001:db8::1]:80", nil},
+		{"well-formed", []byte{Ver5, CmdConnect, 0, AddrIPv4, 192, 0, 2, 1, 0, 80}, "192.0.2.1:80", nil},
+		// 1.2.3.4 without RSV, which reads as RSV 1 and ATYP IPv4
+		{"ambiguous", []byte{Ver5, CmdConnect, AddrIPv4, 1, 2, 3, 4, 0, 80, 0}, "2.3.4.0:20480", ErrBadFormat},
+	}
+
+	for _, tt := range tests {
+		for _, strict := range []bool{false, true} {
+			opts := &DecodeOptions{QuirkMode: true, StrictRSV: strict}
+			for _, r := range []io.Reader{bytes.NewReader(tt.frame), bufio.NewReader(bytes.NewReader(tt.frame))} {
+				req, err := ReadRequestWithOptions(r, opts)
+				if strict && tt.err != nil {
+					if !errors.Is(err, tt.err) {
+						t.Errorf("%s, StrictRSV: %v, want %v", tt.name, err, tt.err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s: %v", tt.name, err)
+					continue
+				}
+				if req.Cmd != CmdConnect || req.Addr.String() != tt.want {
+					t.Errorf("%s: read %v, want %d %s", tt.name, req, CmdConnect, tt.want)
+				}
+			}
+		}
+	}
+
+	// without QuirkMode, a missing RSV garbles the request
+	frame := append(append([]byte{Ver5, CmdConnect, AddrDomain, 11}, "example.com"...), 0, 80)
+	if _, err := ReadRequest(bytes.NewReader(frame)); err == nil {
+		t.Error("ReadRequest without RSV succeeded")
+	}
+}
+
+func TestReadRequestFastPath(t *testing.T) {
+	frames := [][]byte{
+		{Ver5, CmdConnect, 0, AddrIPv4, 192, 0, 2, 1, 0x01, 0xBB},
+		{Ver5, CmdBind, 0, AddrIPv4, 0, 0, 0, 0, 0, 0},
+		{Ver5, CmdConnect, 1, AddrIPv4, 192, 0, 2, 1, 0x01, 0xBB},
+		{Ver5, CmdConnect, 0, AddrDomain, 3, 'f', 'o', 'o', 0, 80},
+		{Ver5, CmdConnect, 0, AddrIPv4, 192, 0, 2},
+		{4, CmdConnect, 0, AddrIPv4, 192, 0, 2, 1, 0x01, 0xBB},
+	}
+	for _, opts := range []*DecodeOptions{nil, {StrictRSV: true}} {
+		for _, b := range frames {
+			// the trailing byte lets the buffered reader hold the whole
+			// frame while telling how much of the input was consumed
+			in := append(append([]byte{}, b...), 0xAA)
+
+			br := bufio.NewReader(bytes.NewReader(in))
+			fast, fastErr := ReadRequestWithOptions(br, opts)
+			general, generalErr := ReadRequestWithOptions(iotest.OneByteReader(bytes.NewReader(in)), opts)
+
+			if fmt.Sprint(fastErr) != fmt.Sprint(generalErr) {
+				t.Errorf("% x: fast path %v, general path %v", b, fastErr, generalErr)
+				continue
+			}
+			if fastErr == nil && (fast.Cmd != general.Cmd || *fast.Addr != *general.Addr) {
+				t.Errorf("% x: fast path %v, general path %v", b, fast, general)
+			}
+			if fastErr == nil && br.Buffered() != 1 {
+				t.Errorf("% x: %d bytes left unread, want 1", b, br.Buffered())
+			}
+		}
+	}
+}
+
+func TestReadMethodSelection(t *testing.T) {
+	tests := []struct {
+		b      []byte
+		method uint8
+		err    error
+	}{
+		{[]byte{0x05, 0x00}, MethodNoAuth, nil},
+		{[]byte{0x05, 0x02}, MethodUserPass, nil},
+		{[]byte{0x05, 0xFF}, 0, ErrNoAcceptableMethod},
+		{[]byte{0x04, 0x00}, 0, ErrBadVersion},
+	}
+
+	for _, tt := range tests {
+		method, err := ReadMethodSelection(bytes.NewReader(tt.b))
+		if method != tt.method || !errors.Is(err, tt.err) {
+			t.Errorf("ReadMethodSelection(% x) = %d, %v, want %d, %v",
+				tt.b, method, err, tt.method, tt.err)
+		}
+	}
+}
+
+func TestUserPassRequestEdgeLengths(t *testing.T) {
+	max := strings.Repeat("x", 255)
+	tests := []struct {
+		username, password string
+	}{
+		{"", ""},
+		{"", "pass"},
+		{"user", ""},
+		{"user", "pass"},
+		{max, max},
+		{max, ""},
+		{"", max},
+	}
+
+	for _, tt := range tests {
+		buf := &bytes.Buffer{}
+		if err := NewUserPassRequest(UserPassVer, tt.username, tt.password).Write(buf); err != nil {
+			t.Fatalf("Write(%d, %d): %v", len(tt.username), len(tt.password), err)
+		}
+		if want := 3 + len(tt.username) + len(tt.password); buf.Len() != want {
+			t.Errorf("Write(%d, %d) wrote %d bytes, want %d",
+				len(tt.username), len(tt.password), buf.Len(), want)
+		}
+
+		// a frame following the request, as if pipelined, must be left
+		// unread even when a length is zero
+		buf.WriteString("next")
+		r := bufio.NewReader(buf)
+
+		req, err := ReadUserPassRequest(r)
+		if err != nil {
+			t.Fatalf("ReadUserPassRequest(%d, %d): %v", len(tt.username), len(tt.password), err)
+		}
+		if req.Username != tt.username || req.Password != tt.password {
+			t.Errorf("ReadUserPassRequest(%d, %d) = %d, %d",
+				len(tt.username), len(tt.password), len(req.Username), len(req.Password))
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "next" {
+			t.Errorf("ReadUserPassRequest(%d, %d) left %q unread, want %q",
+				len(tt.username), len(tt.password), rest, "next")
+		}
+	}
+}
+
+func TestUserPassRequestTooLong(t *testing.T) {
+	long := strings.Repeat("x", 256)
+	for _, req := range []*UserPassRequest{
+		NewUserPassRequest(UserPassVer, long, ""),
+		NewUserPassRequest(UserPassVer, "", long),
+	} {
+		if err := req.Write(io.Discard); err != ErrBadFormat {
+			t.Errorf("Write(%d, %d): %v, want %v",
+				len(req.Username), len(req.Password), err, ErrBadFormat)
+		}
+	}
+}
+
+func TestUserPassResponseOK(t *testing.T) {
+	for _, tt := range []struct {
+		status uint8
+		ok     bool
+	}{
+		{AuthSuccess, true},
+		{AuthFailure, false},
+		{0xFF, false},
+	} {
+		res, err := ReadUserPassResponse(bytes.NewReader([]byte{UserPassVer, tt.status}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.OK() != tt.ok {
+			t.Errorf("status %#x: OK() = %t, want %t", tt.status, res.OK(), tt.ok)
+		}
+	}
+}
+
+func TestReadMethodsPipelinedAuth(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{Ver5, 2, MethodNoAuth, MethodUserPass})
+	if err := NewUserPassRequest(UserPassVer, "user", "pass").Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	methods, err := ReadMethods(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(methods, []uint8{MethodNoAuth, MethodUserPass}) {
+		t.Errorf("methods = %v", methods)
+	}
+
+	req, err := ReadUserPassRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Username != "user" || req.Password != "pass" {
+		t.Errorf("userpass = %q:%q, want %q:%q", req.Username, req.Password, "user", "pass")
+	}
+}
+
+func TestReadUserPassRequestPipelinedRequest(t *testing.T) {
+	handshake := append(gosocks5test.UserPassRequest(), gosocks5test.RequestIPv4()...)
+	// unbuffered, and handing out as much as asked for at once
+	r := struct{ io.Reader }{bytes.NewReader(handshake)}
+
+	if _, err := ReadUserPassRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRequest(r); err != nil {
+		t.Errorf("ReadRequest after the userpass request: %v", err)
+	}
+}
+
+var roundTripAddrs = []*Addr{
+	{Type: AddrIPv4, Host: "192.0.2.1", Port: 80},
+	{Type: AddrIPv6, Host: "2001:db8::1", Port: 443},
+	{Type: AddrDomain, Host: "example.com", Port: 8080},
+	{Type: AddrDomain, Host: strings.Repeat("a", 255), Port: 65535},
+}
+
+func TestAddrDecodeFrom(t *testing.T) {
+	for _, addr := range roundTripAddrs {
+		b, err := addr.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(%v): %v", addr, err)
+		}
+
+		got := new(Addr)
+		n, err := got.DecodeFrom(append(b, "trailing"...))
+		if err != nil {
+			t.Fatalf("DecodeFrom(%v): %v", addr, err)
+		}
+		if n != len(b) {
+			t.Errorf("DecodeFrom(%v) consumed %d bytes, want %d", addr, n, len(b))
+		}
+		if *got != *addr {
+			t.Errorf("DecodeFrom = %+v, want %+v", got, addr)
+		}
+
+		if _, err := new(Addr).DecodeFrom(b[:len(b)-1]); err != ErrShortBuffer {
+			t.Errorf("DecodeFrom(%v) of short buffer: %v, want %v", addr, err, ErrShortBuffer)
+		}
+	}
+}
+
+func TestRequestReplyClone(t *testing.T) {
+	req := NewRequest(CmdConnect, &Addr{Type: AddrDomain, Host: "example.com", Port: 80})
+	clone := req.Clone()
+	clone.Cmd = CmdBind
+	clone.Addr.Host = "192.0.2.1"
+	clone.Addr.Type = AddrIPv4
+	if req.Cmd != CmdConnect || req.Addr.Type != AddrDomain || req.Addr.Host != "example.com" {
+		t.Errorf("changing the clone changed the request to %v", req)
+	}
+
+	rep := NewReply(Succeeded, &Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 1080})
+	rclone := rep.Clone()
+	rclone.Rep = Failure
+	rclone.Addr.Port = 0
+	if rep.Rep != Succeeded || rep.Addr.Port != 1080 {
+		t.Errorf("changing the clone changed the reply to %v", rep)
+	}
+
+	if NewRequest(CmdConnect, nil).Clone().Addr != nil || NewReply(Succeeded, nil).Clone().Addr != nil {
+		t.Error("clone of a nil Addr is not nil")
+	}
+}
+
+func TestReadRaw(t *testing.T) {
+	// RSV 1, which writing the request back out would turn into 0
+	odd := []byte{Ver5, CmdConnect, 1, AddrIPv4, 192, 0, 2, 1, 0, 80}
+	for _, frame := range [][]byte{odd, gosocks5test.RequestIPv4(), gosocks5test.RequestDomainMax()} {
+		for _, r := range []io.Reader{bytes.NewReader(append(frame, 0xA5)), bufio.NewReader(bytes.NewReader(append(frame, 0xA5)))} {
+			req, raw, err := ReadRequestRaw(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(raw, frame) {
+				t.Errorf("ReadRequestRaw of %v = % x, want % x", req, raw, frame)
+			}
+		}
+	}
+
+	frame := gosocks5test.Reply()
+	rep, raw, err := ReadReplyRaw(bytes.NewReader(append(frame, 0xA5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, frame) {
+		t.Errorf("ReadReplyRaw of %v = % x, want % x", rep, raw, frame)
+	}
+
+	if _, raw, err := ReadRequestRaw(bytes.NewReader(odd[:5])); !errors.Is(err, io.ErrUnexpectedEOF) || raw != nil {
+		t.Errorf("ReadRequestRaw of a truncated frame = % x, %v", raw, err)
+	}
+}
+
+func TestRequestReplyRoundTrip(t *testing.T) {
+	for _, addr := range roundTripAddrs {
+		b, err := NewRequest(CmdConnect, addr).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := new(Request)
+		if err := req.UnmarshalBinary(b); err != nil {
+			t.Fatalf("Request.UnmarshalBinary(%v): %v", addr, err)
+		}
+		if req.Cmd != CmdConnect || *req.Addr != *addr {
+			t.Errorf("request = %d %+v, want %d %+v", req.Cmd, req.Addr, CmdConnect, addr)
+		}
+
+		b, err = NewReply(HostUnreachable, addr).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ReadReply(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("ReadReply(%v): %v", addr, err)
+		}
+		if rep.Rep != HostUnreachable || *rep.Addr != *addr {
+			t.Errorf("reply = %d %+v, want %d %+v", rep.Rep, rep.Addr, HostUnreachable, addr)
+		}
+	}
+}
+
+func TestReplyDomainBindAddr(t *testing.T) {
+	for _, host := range []string{"a", "relay.example.com", strings.Repeat("a", 255)} {
+		var buf bytes.Buffer
+		addr := &Addr{Type: AddrDomain, Host: host, Port: 1080}
+		if err := NewReply(Succeeded, addr).Write(&buf); err != nil {
+			t.Fatalf("Write(%.20s): %v", host, err)
+		}
+		b := buf.Bytes()
+		if len(b) != 7+len(host) || b[3] != AddrDomain || int(b[4]) != len(host) {
+			t.Fatalf("Write(%.20s) = % x, want %d bytes", host, b[:5], 7+len(host))
+		}
+
+		// a buffered reader is read exactly, so the frame length
+		// ReadReply works out shows in what it leaves behind
+		buf.WriteString("data")
+		br := bufio.NewReader(&buf)
+		rep, err := ReadReply(br)
+		if err != nil {
+			t.Fatalf("ReadReply(%.20s): %v", host, err)
+		}
+		if *rep.Addr != *addr {
+			t.Errorf("ReadReply(%.20s) addr = %+v", host, rep.Addr)
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != "data" {
+			t.Errorf("ReadReply(%.20s) left %q, want the data after the frame", host, rest)
+		}
+	}
+}
+
+func TestAddrLen(t *testing.T) {
+	tests := []struct {
+		atype  uint8
+		b      []byte
+		length int
+		err    error
+	}{
+		{AddrIPv4, nil, 7, nil},
+		{AddrIPv6, nil, 19, nil},
+		{AddrDomain, []byte{0}, 4, nil},
+		{AddrDomain, []byte{11, 'e', 'x'}, 15, nil},
+		{AddrDomain, []byte{255}, 259, nil},
+		{AddrDomain, nil, 0, ErrShortBuffer},
+		{0x02, nil, 0, ErrBadAddrType},
+	}
+
+	for _, tt := range tests {
+		length, err := addrLen(tt.atype, tt.b)
+		if length != tt.length || err != tt.err {
+			t.Errorf("addrLen(%d, % x) = %d, %v, want %d, %v",
+				tt.atype, tt.b, length, err, tt.length, tt.err)
+		}
+	}
+}
+
+func TestReadEOF(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		read  func(r io.Reader) error
+	}{
+		{"methods", []byte{Ver5, 2, MethodNoAuth, MethodUserPass}, func(r io.Reader) error {
+			_, err := ReadMethods(r)
+			return err
+		}},
+		{"method selection", []byte{Ver5, MethodNoAuth}, func(r io.Reader) error {
+			_, err := ReadMethodSelection(r)
+			return err
+		}},
+		{"userpass request", []byte{UserPassVer, 1, 'u', 1, 'p'}, func(r io.Reader) error {
+			_, err := ReadUserPassRequest(r)
+			return err
+		}},
+		{"userpass response", []byte{UserPassVer, AuthSuccess}, func(r io.Reader) error {
+			_, err := ReadUserPassResponse(r)
+			return err
+		}},
+		{"request", []byte{Ver5, CmdConnect, 0, AddrDomain, 4, 'h', 'o', 's', 't', 0, 80}, func(r io.Reader) error {
+			_, err := ReadRequest(r)
+			return err
+		}},
+		{"reply", []byte{Ver5, Succeeded, 0, AddrIPv4, 127, 0, 0, 1, 0, 80}, func(r io.Reader) error {
+			_, err := ReadReply(r)
+			return err
+		}},
+		{"udp datagram", []byte{0, 2, 0, AddrDomain, 4, 'h', 'o', 's', 't', 0, 53, 'h', 'i'}, func(r io.Reader) error {
+			_, err := ReadUDPDatagram(r)
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		if err := tt.read(bytes.NewReader(tt.frame)); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if err := tt.read(bytes.NewReader(nil)); err != io.EOF {
+			t.Errorf("%s, no input: %v, want io.EOF", tt.name, err)
+		}
+		for n := 1; n < len(tt.frame); n++ {
+			err := tt.read(bufio.NewReader(bytes.NewReader(tt.frame[:n])))
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s, %d of %d bytes: %v, want io.ErrUnexpectedEOF", tt.name, n, len(tt.frame), err)
+			}
+			err = tt.read(iotest.OneByteReader(bytes.NewReader(tt.frame[:n])))
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s, %d of %d bytes one at a time: %v, want io.ErrUnexpectedEOF", tt.name, n, len(tt.frame), err)
+			}
+		}
+	}
+}
+
+// TestReadShortReads reads every frame through readers that return less
+// than asked for, which must decode it just as a whole read does. One byte
+// at a time, a reader must also consume exactly the frame.
+func TestReadShortReads(t *testing.T) {
+	decode := func(read func(r io.Reader) (fmt.Stringer, error)) func(r io.Reader) (string, error) {
+		return func(r io.Reader) (string, error) {
+			v, err := read(r)
+			if err != nil {
+				return "", err
+			}
+			return v.String(), nil
+		}
+	}
+	methods := func(r io.Reader) (string, error) {
+		m, err := ReadMethods(r)
+		return fmt.Sprint(m), err
+	}
+	methodSelection := func(r io.Reader) (string, error) {
+		m, err := ReadMethodSelection(r)
+		return fmt.Sprint(m), err
+	}
+	userPassRequest := func(r io.Reader) (string, error) {
+		req, err := ReadUserPassRequest(r)
+		if err != nil {
+			return "", err
+		}
+		return req.Username + ":" + req.Password, nil
+	}
+	userPassResponse := func(r io.Reader) (string, error) {
+		res, err := ReadUserPassResponse(r)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprint(res.Status), nil
+	}
+	request := decode(func(r io.Reader) (fmt.Stringer, error) { return ReadRequest(r) })
+	reply := decode(func(r io.Reader) (fmt.Stringer, error) { return ReadReply(r) })
+	datagram := func(r io.Reader) (string, error) {
+		d, err := ReadUDPDatagram(r)
+		if err != nil {
+			return "", err
+		}
+		return d.Header.Addr.String() + " " + string(d.Data), nil
+	}
+
+	// a datagram with RSV 0 is taken to be whatever one Read returns, as
+	// from a packet conn, so only the RSV-as-length framing of tunnelled
+	// datagrams can be read in pieces
+	tunnelled := gosocks5test.UDPDatagram()
+	tunnelled[1] = byte(len(gosocks5test.Payload))
+
+	tests := []struct {
+		name  string
+		frame []byte
+		read  func(r io.Reader) (string, error)
+	}{
+		{"methods", gosocks5test.Methods(), methods},
+		{"max methods", gosocks5test.MethodsMax(), methods},
+		{"method selection", gosocks5test.MethodSelection(), methodSelection},
+		{"userpass request", gosocks5test.UserPassRequest(), userPassRequest},
+		{"max userpass request", gosocks5test.UserPassRequestMax(), userPassRequest},
+		{"userpass response", gosocks5test.UserPassResponse(), userPassResponse},
+		{"IPv4 request", gosocks5test.RequestIPv4(), request},
+		{"IPv6 request", gosocks5test.RequestIPv6(), request},
+		{"domain request", gosocks5test.RequestDomain(), request},
+		{"max domain request", gosocks5test.RequestDomainMax(), request},
+		{"reply", gosocks5test.Reply(), reply},
+		{"tunnelled datagram", tunnelled, datagram},
+	}
+	readers := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{"one byte", iotest.OneByteReader},
+		{"half", iotest.HalfReader},
+		{"data with error", iotest.DataErrReader},
+	}
+
+	const next = 0xA5
+	for _, tt := range tests {
+		want, err := tt.read(bytes.NewReader(tt.frame))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, rd := range readers {
+			src := bytes.NewReader(append(tt.frame, next))
+			got, err := tt.read(rd.wrap(src))
+			if err != nil {
+				t.Errorf("%s, %s reader: %v", tt.name, rd.name, err)
+				continue
+			}
+			if got != want {
+				t.Errorf("%s, %s reader: got %q, want %q", tt.name, rd.name, got, want)
+			}
+			if rd.name != "one byte" {
+				continue
+			}
+			if b, err := src.ReadByte(); err != nil || b != next {
+				t.Errorf("%s, %s reader: read past the frame", tt.name, rd.name)
+			}
+		}
+	}
+}
+
+func TestReadErrorContext(t *testing.T) {
+	_, err := ReadRequest(bytes.NewReader([]byte{4, CmdConnect, 0, AddrIPv4, 0, 0, 0, 0, 0, 0}))
+	if !errors.Is(err, ErrBadVersion) {
+		t.Fatalf("ReadRequest: %v, want %v", err, ErrBadVersion)
+	}
+	if want := "reading request: " + ErrBadVersion.Error(); err.Error() != want {
+		t.Errorf("ReadRequest: %q, want %q", err, want)
+	}
+}
+
+func TestReadErrorConsumed(t *testing.T) {
+	tests := []struct {
+		name     string
+		read     func(r io.Reader) error
+		b        []byte
+		consumed int
+		err      error
+	}{
+		{"bad version", readRequestErr, []byte{4, CmdConnect, 0, AddrIPv4, 127, 0, 0, 1, 0, 80}, 5, ErrBadVersion},
+		{"bad address type", readRequestErr, []byte{Ver5, CmdConnect, 0, 9, 127, 0, 0, 1, 0, 80}, 5, ErrBadAddrType},
+		{"truncated address", readRequestErr, []byte{Ver5, CmdConnect, 0, AddrIPv4, 127, 0}, 6, io.ErrUnexpectedEOF},
+		{"no methods", func(r io.Reader) error { _, err := ReadMethods(r); return err }, []byte{Ver5, 0, MethodNoAuth}, 2, ErrBadMethod},
+	}
+
+	for _, tt := range tests {
+		err := tt.read(bufio.NewReader(bytes.NewReader(tt.b)))
+		var fe *FrameError
+		if !errors.As(err, &fe) || !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want a *FrameError wrapping %v", tt.name, err, tt.err)
+			continue
+		}
+		if fe.Consumed != tt.consumed {
+			t.Errorf("%s: consumed %d bytes, want %d", tt.name, fe.Consumed, tt.consumed)
+		}
+	}
+}
+
+func readRequestErr(r io.Reader) error {
+	_, err := ReadRequest(r)
+	return err
+}
+
+func TestReadReplyStrictReplyCode(t *testing.T) {
+	b := []byte{Ver5, 0x0A, 0, AddrIPv4, 127, 0, 0, 1, 0, 80}
+
+	rep, err := ReadReplyWithOptions(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatalf("lenient: %v", err)
+	}
+	if rep.Rep != 0x0A {
+		t.Errorf("lenient: reply code = %d, want %d", rep.Rep, 0x0A)
+	}
+
+	_, err = ReadReplyWithOptions(bytes.NewReader(b), &DecodeOptions{StrictReplyCode: true})
+	if !errors.Is(err, ErrBadReplyCode) {
+		t.Errorf("strict: %v, want %v", err, ErrBadReplyCode)
+	}
+
+	b[1] = AddrUnsupported
+	if _, err := ReadReplyWithOptions(bytes.NewReader(b), &DecodeOptions{StrictReplyCode: true}); err != nil {
+		t.Errorf("strict, code %d: %v", AddrUnsupported, err)
+	}
+}
+
+func TestReadMethodsNotSocks5(t *testing.T) {
+	tests := []struct {
+		b   string
+		err error
+	}{
+		{"GET / HTTP/1.1\r\n", ErrNotSocks5},
+		{"CONNECT example.com:443 HTTP/1.1\r\n", ErrNotSocks5},
+		{"\x04\x01\x00\x50", ErrBadVersion},
+		{"\x05\x00", ErrBadMethod},
+	}
+	for _, tt := range tests {
+		if _, err := ReadMethods(strings.NewReader(tt.b)); !errors.Is(err, tt.err) {
+			t.Errorf("%q: %v, want %v", tt.b, err, tt.err)
+		}
+	}
+}
+
+func TestEncodeHandshake(t *testing.T) {
+	tests := []struct {
+		methods []uint8
+		want    []byte
+	}{
+		{nil, []byte{Ver5, 1, MethodNoAuth}},
+		{[]uint8{MethodNoAuth, MethodUserPass}, []byte{Ver5, 2, MethodNoAuth, MethodUserPass}},
+	}
+	for _, tt := range tests {
+		if b := EncodeHandshake(tt.methods); !bytes.Equal(b, tt.want) {
+			t.Errorf("EncodeHandshake(%v) = % x, want % x", tt.methods, b, tt.want)
+		}
+	}
+
+	methods, err := ReadMethods(bytes.NewReader(EncodeHandshake(make([]uint8, 300))))
+	if err != nil || len(methods) != 255 {
+		t.Errorf("300 methods: read %d methods, %v, want 255", len(methods), err)
+	}
+}
+
+func TestEncodeRequest(t *testing.T) {
+	b, err := EncodeRequest(CmdConnect, benchRequest.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := benchRequest.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, buf.Bytes()) {
+		t.Errorf("EncodeRequest = % x, Write sent % x", b, buf.Bytes())
+	}
+
+	if _, err := EncodeRequest(CmdConnect, nil); err != ErrBadFormat {
+		t.Errorf("nil address: %v, want %v", err, ErrBadFormat)
+	}
+}
+
+func TestReplyWriteStrictReplyCode(t *testing.T) {
+	rep := NewReply(0x09, nil)
+	if err := rep.Write(io.Discard); err != nil {
+		t.Errorf("lenient: %v", err)
+	}
+	strict := &EncodeOptions{StrictReplyCode: true}
+	if err := rep.WriteWithOptions(io.Discard, strict); err != ErrBadReplyCode {
+		t.Errorf("strict: %v, want %v", err, ErrBadReplyCode)
+	}
+	if err := NewReply(AddrUnsupported, nil).WriteWithOptions(io.Discard, strict); err != nil {
+		t.Errorf("strict, code %d: %v", AddrUnsupported, err)
+	}
+}
+
+func TestRequestWriteNilAddr(t *testing.T) {
+	for _, cmd := range []uint8{CmdConnect, CmdBind} {
+		if err := NewRequest(cmd, nil).Write(io.Discard); err != ErrBadFormat {
+			t.Errorf("command %d: %v, want %v", cmd, err, ErrBadFormat)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := NewRequest(CmdUdp, nil).Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{Ver5, CmdUdp, 0, AddrIPv4, 0, 0, 0, 0, 0, 0}; !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("UDP ASSOCIATE = % x, want % x", buf.Bytes(), want)
+	}
+}
+
+func TestEmptyDomain(t *testing.T) {
+	b := []byte{Ver5, CmdConnect, 0, AddrDomain, 0, 0, 80}
+	if _, err := ReadRequest(bytes.NewReader(b)); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("ReadRequest: %v, want %v", err, ErrBadFormat)
+	}
+
+	addr := &Addr{Type: AddrDomain, Port: 80}
+	if _, err := addr.MarshalBinary(); err != ErrBadFormat {
+		t.Errorf("MarshalBinary: %v, want %v", err, ErrBadFormat)
+	}
+}
+
+func TestAddrDecodeTrailing(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want Addr
+	}{
+		{[]byte{AddrIPv4, 192, 0, 2, 1, 0x01, 0xBB, 0xFF, 0xFF}, Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 443}},
+		{[]byte{AddrDomain, 3, 'f', 'o', 'o', 0, 80, 0xFF}, Addr{Type: AddrDomain, Host: "foo", Port: 80}},
+	}
+	for _, tt := range tests {
+		var addr Addr
+		if err := addr.Decode(tt.b); err != nil {
+			t.Errorf("% x: %v", tt.b, err)
+			continue
+		}
+		if addr != tt.want {
+			t.Errorf("% x: decoded %+v, want %+v", tt.b, addr, tt.want)
+		}
+	}
+
+	for _, b := range [][]byte{
+		{},
+		{AddrIPv4, 192, 0, 2},
+		{AddrIPv4, 192, 0, 2, 1, 0},
+		{AddrDomain},
+		{AddrDomain, 3, 'f', 'o'},
+	} {
+		if err := new(Addr).Decode(b); !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("% x: %v, want %v", b, err, ErrShortBuffer)
+		}
+	}
+}
+
+func TestAddrDecodeShortMessage(t *testing.T) {
+	EnableUnixAddr = true
+	defer func() { EnableUnixAddr = false }()
+
+	tests := []struct {
+		b    []byte
+		want string
+	}{
+		{[]byte{AddrIPv4, 192, 0, 2}, "address type IPv4 requires 4 bytes, got 3"},
+		{[]byte{AddrIPv4, 192, 0, 2, 1, 0}, "address type IPv4 requires 2 port bytes, got 1"},
+		{append([]byte{AddrIPv6}, make([]byte, 15)...), "address type IPv6 requires 16 bytes, got 15"},
+		{[]byte{AddrIPv6, 192, 0, 2, 1, 0, 80}, "address type IPv6 requires 16 bytes, got 6"},
+		{append([]byte{AddrIPv6}, make([]byte, 17)...), "address type IPv6 requires 2 port bytes, got 1"},
+		{[]byte{AddrDomain}, "address type domain requires 1 byte, got 0"},
+		{[]byte{AddrDomain, 3, 'f', 'o'}, "address type domain requires 4 bytes, got 3"},
+		{[]byte{AddrDomain, 3, 'f', 'o', 'o', 0}, "address type domain requires 2 port bytes, got 1"},
+		{[]byte{AddrUnix, 4, '/', 't', 'm'}, "address type Unix requires 5 bytes, got 4"},
+	}
+	for _, tt := range tests {
+		err := new(Addr).Decode(tt.b)
+		var lerr *AddrLenError
+		if !errors.As(err, &lerr) || !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("% x: %v, want an *AddrLenError wrapping %v", tt.b, err, ErrShortBuffer)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("% x: %q, want %q", tt.b, err, tt.want)
+		}
+	}
+}
+
+func TestReadReplyLenientReplyAddr(t *testing.T) {
+	opts := &DecodeOptions{LenientReplyAddr: true}
+	for _, b := range [][]byte{
+		{Ver5, Succeeded, 0},
+		{Ver5, Succeeded, 0, AddrIPv4, 192, 0},
+	} {
+		if _, err := ReadReply(bytes.NewReader(b)); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("strict, % x: %v, want %v", b, err, io.ErrUnexpectedEOF)
+		}
+		rep, err := ReadReplyWithOptions(bytes.NewReader(b), opts)
+		if err != nil {
+			t.Errorf("lenient, % x: %v", b, err)
+			continue
+		}
+		if rep.Rep != Succeeded || rep.Addr.String() != "0.0.0.0:0" {
+			t.Errorf("lenient, % x: %v", b, rep)
+		}
+	}
+
+	b := []byte{Ver5, Failure, 0}
+	if _, err := ReadReplyWithOptions(bytes.NewReader(b), opts); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("lenient failure reply: %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	b = []byte{4, Succeeded, 0}
+	if _, err := ReadReplyWithOptions(bytes.NewReader(b), opts); !errors.Is(err, ErrBadVersion) {
+		t.Errorf("lenient, % x: %v, want %v", b, err, ErrBadVersion)
+	}
+
+	// ATYP 0 ends the reply, with no need for the stream to end
+	b = []byte{Ver5, Succeeded, 0, 0, 'd', 'a', 't', 'a'}
+	if _, err := ReadReply(bytes.NewReader(b)); !errors.Is(err, ErrBadAddrType) {
+		t.Errorf("strict, % x: %v, want %v", b, err, ErrBadAddrType)
+	}
+	r := bufio.NewReader(bytes.NewReader(b))
+	rep, err := ReadReplyWithOptions(r, opts)
+	if err != nil {
+		t.Fatalf("lenient, % x: %v", b, err)
+	}
+	if rep.Rep != Succeeded || rep.Addr.String() != "0.0.0.0:0" {
+		t.Errorf("lenient, % x: %v", b, rep)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "data" {
+		t.Errorf("lenient, % x: %q left unread, want %q", b, rest, "data")
+	}
+}
+
+func TestReplyBindPortZero(t *testing.T) {
+	for _, addr := range []*Addr{
+		{Type: AddrIPv4, Host: "192.0.2.1", Port: 0},
+		{Type: AddrDomain, Host: "bind.example.com", Port: 0},
+	} {
+		buf := &bytes.Buffer{}
+		if err := NewReply(Succeeded, addr).Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ReadReply(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *rep.Addr != *addr || rep.BindPort() != 0 {
+			t.Errorf("reply = %+v, port %d, want %+v, port 0", rep.Addr, rep.BindPort(), addr)
+		}
+	}
+
+	if port := NewReply(Succeeded, nil).BindPort(); port != 0 {
+		t.Errorf("BindPort() of nil Addr = %d, want 0", port)
+	}
+}
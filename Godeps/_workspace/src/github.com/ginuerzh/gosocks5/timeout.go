@@ -0,0 +1,69 @@
+package gosocks5
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// The *Timeout variants of the Read functions bound the read with a deadline
+// of d from now, clear the deadline afterwards and report an expired
+// deadline as ErrTimeout.
+
+func ReadMethodsTimeout(c net.Conn, d time.Duration) (methods []uint8, err error) {
+	err = readTimeout(c, d, func() (err error) {
+		methods, err = ReadMethods(c)
+		return
+	})
+	return
+}
+
+func ReadUserPassRequestTimeout(c net.Conn, d time.Duration) (req *UserPassRequest, err error) {
+	err = readTimeout(c, d, func() (err error) {
+		req, err = ReadUserPassRequest(c)
+		return
+	})
+	return
+}
+
+func ReadUserPassResponseTimeout(c net.Conn, d time.Duration) (res *UserPassResponse, err error) {
+	err = readTimeout(c, d, func() (err error) {
+		res, err = ReadUserPassResponse(c)
+		return
+	})
+	return
+}
+
+func ReadRequestTimeout(c net.Conn, d time.Duration) (req *Request, err error) {
+	err = readTimeout(c, d, func() (err error) {
+		req, err = ReadRequest(c)
+		return
+	})
+	return
+}
+
+func ReadReplyTimeout(c net.Conn, d time.Duration) (rep *Reply, err error) {
+	err = readTimeout(c, d, func() (err error) {
+		rep, err = ReadReply(c)
+		return
+	})
+	return
+}
+
+func readTimeout(c net.Conn, d time.Duration, read func() error) error {
+	if err := c.SetReadDeadline(time.Now().Add(d)); err != nil {
+		return err
+	}
+	err := read()
+	c.SetReadDeadline(time.Time{})
+	return timeoutErr(err)
+}
+
+// timeoutErr reports an expired deadline as ErrTimeout.
+func timeoutErr(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrTimeout
+	}
+	return err
+}
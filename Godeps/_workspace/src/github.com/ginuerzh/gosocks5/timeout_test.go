@@ -0,0 +1,107 @@
+package gosocks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadTimeout(t *testing.T) {
+	client, server := tcpPair(t)
+
+	// the client stalls
+	const d = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := ReadRequestTimeout(server, d); err != ErrTimeout {
+		t.Fatalf("ReadRequestTimeout: %v, want %v", err, ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < d {
+		t.Errorf("timed out after %v, before %v", elapsed, d)
+	}
+
+	// with the deadline cleared, a read after it would have passed succeeds
+	go func() {
+		time.Sleep(2 * d)
+		NewRequest(CmdConnect, NewIPAddr(benchIP, 443)).Write(client)
+	}()
+	req, err := ReadRequest(server)
+	if err != nil {
+		t.Fatalf("ReadRequest after timeout: %v", err)
+	}
+	if req.Addr.Port != 443 {
+		t.Errorf("read %v", req)
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	const d = 100 * time.Millisecond
+	s := &Server{
+		HandshakeTimeout: d,
+		HandleRequest: func(w ReplyWriter, req *Request) error {
+			if err := w.Reply(Succeeded, nil); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, w)
+			return err
+		},
+	}
+	addr := startServer(t, s)
+
+	// a client that trickles in its method selection is cut off
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	for _, b := range EncodeHandshake([]uint8{MethodNoAuth}) {
+		if _, err := c.Write([]byte{b}); err != nil {
+			break
+		}
+		time.Sleep(d / 2)
+	}
+	// EOF, or a reset if the last write came too late
+	io.ReadAll(c)
+	if elapsed := time.Since(start); elapsed < d || elapsed > 10*d {
+		t.Errorf("disconnected after %v, want about %v", elapsed, d)
+	}
+
+	// the deadline no longer applies once the request is replied to
+	conn, err := (&Client{Addr: addr.String()}).Dial("tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(2 * d)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("reading after the handshake timeout: %v", err)
+	}
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	// a server that never answers the method selection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	client := &Client{Addr: ln.Addr().String(), HandshakeTimeout: 50 * time.Millisecond}
+	if _, err := client.Dial("tcp", "192.0.2.1:80"); err != ErrTimeout {
+		t.Errorf("Dial with a silent server: %v, want %v", err, ErrTimeout)
+	}
+}
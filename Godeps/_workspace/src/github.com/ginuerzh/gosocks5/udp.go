@@ -0,0 +1,132 @@
+package gosocks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// serveUDP relays datagrams for the UDP association of the client at
+// clientAddr on relay, until relay is closed. Datagrams from the client are
+// unwrapped and forwarded to their target; datagrams from a target the
+// client has sent to are wrapped and returned to the client. Anything else
+// is dropped, as are datagrams that fail to parse or to send and those, in
+// either direction, larger than the MaxUDPDatagramSize of
+// Config.DecodeOptions. An unspecified
+// IP or a zero port in clientAddr matches any, until the first datagram from
+// the client fixes its address.
+func (s *Server) serveUDP(relay net.PacketConn, clientAddr net.Addr) error {
+	client, ok := clientAddr.(*net.UDPAddr)
+	if !ok {
+		return ErrBadFormat
+	}
+	targets := make(map[string]bool)
+
+	size := MaxUDPDatagramSize
+	if opts := s.decodeOptions(); opts != nil && opts.MaxUDPDatagramSize > 0 {
+		size = opts.MaxUDPDatagramSize
+	}
+	// one spare byte to tell a datagram over the limit
+	b := make([]byte, size+1)
+	for {
+		n, from, err := relay.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if n > size {
+			continue
+		}
+
+		// targets first, as a client matching any port would take in the
+		// answers of targets on the same host
+		if targets[from.String()] {
+			returnUDP(relay, client, from, b[:n])
+			continue
+		}
+		if matchUDPAddr(client, from) {
+			// the first datagram completes a partial client address
+			client = from.(*net.UDPAddr)
+			if raddr, err := s.forwardUDP(relay, b[:n]); err == nil && raddr != nil {
+				targets[raddr.String()] = true
+			}
+		}
+	}
+}
+
+// forwardUDP relays one datagram b, received from a client on relay, to the
+// target named in its header, resolved as for CONNECT, and returns the
+// target. Datagrams rejected by TargetFilter or DenyIPv6, and fragments,
+// which are not supported, are dropped without
+// error and yield a nil address, as UDP has no way to tell the client.
+func (s *Server) forwardUDP(relay net.PacketConn, b []byte) (*net.UDPAddr, error) {
+	dgram, err := ParseUDPDatagramWithOptions(b, s.decodeOptions())
+	if err != nil {
+		return nil, err
+	}
+	if dgram.Header.Frag != 0 {
+		return nil, nil
+	}
+
+	if s.TargetFilter != nil && !s.TargetFilter(dgram.Header.Addr) {
+		atomic.AddUint64(&s.droppedUDP, 1)
+		return nil, nil
+	}
+
+	taddr, err := s.resolve(context.Background(), dgram.Header.Addr)
+	if err != nil {
+		return nil, err
+	}
+	raddr := &net.UDPAddr{IP: taddr.IP, Port: taddr.Port, Zone: taddr.Zone}
+	if s.DenyIPv6 && raddr.IP.To4() == nil {
+		atomic.AddUint64(&s.droppedUDP, 1)
+		return nil, nil
+	}
+	if _, err := relay.WriteTo(dgram.Data, raddr); err != nil {
+		return nil, err
+	}
+	return raddr, nil
+}
+
+// returnUDP wraps data, received on relay from target, and sends it to the
+// client.
+func returnUDP(relay net.PacketConn, client *net.UDPAddr, target net.Addr, data []byte) error {
+	addr, err := NewAddrFromNetAddr(target)
+	if err != nil {
+		return err
+	}
+
+	b, err := NewUDPDatagram(NewUDPHeader(0, 0, addr), data).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = relay.WriteTo(b, client)
+	return err
+}
+
+func matchUDPAddr(want *net.UDPAddr, addr net.Addr) bool {
+	got, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if len(want.IP) != 0 && !want.IP.IsUnspecified() && !want.IP.Equal(got.IP) {
+		return false
+	}
+	return want.Port == 0 || want.Port == got.Port
+}
+
+func (s *Server) decodeOptions() *DecodeOptions {
+	if s.Config == nil {
+		return nil
+	}
+	return s.Config.DecodeOptions
+}
+
+// DroppedDatagrams returns the number of UDP datagrams dropped by
+// TargetFilter or DenyIPv6.
+func (s *Server) DroppedDatagrams() uint64 {
+	return atomic.LoadUint64(&s.droppedUDP)
+}
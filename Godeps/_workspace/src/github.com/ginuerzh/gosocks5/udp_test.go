@@ -0,0 +1,541 @@
+package gosocks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5/gosocks5test"
+)
+
+func listenUDP(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func encodeDatagram(t *testing.T, target net.Addr, data []byte) []byte {
+	addr, err := NewAddrFromNetAddr(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := NewUDPDatagram(NewUDPHeader(0, 0, addr), data).Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestServerTargetFilterDropsDatagram(t *testing.T) {
+	relay := listenUDP(t)
+	allowed := listenUDP(t)
+	denied := listenUDP(t)
+
+	deniedPort := uint16(denied.LocalAddr().(*net.UDPAddr).Port)
+	s := &Server{
+		TargetFilter: func(addr *Addr) bool {
+			return addr.Port != deniedPort
+		},
+	}
+
+	sent, err := s.forwardUDP(relay, encodeDatagram(t, denied.LocalAddr(), []byte("deny")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != nil {
+		t.Error("datagram to denied target was sent")
+	}
+	if n := s.DroppedDatagrams(); n != 1 {
+		t.Errorf("DroppedDatagrams() = %d, want 1", n)
+	}
+
+	sent, err = s.forwardUDP(relay, encodeDatagram(t, allowed.LocalAddr(), []byte("allow")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent == nil {
+		t.Error("datagram to allowed target was dropped")
+	}
+
+	b := make([]byte, 64)
+	allowed.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := allowed.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "allow" {
+		t.Errorf("allowed target got %q, want %q", b[:n], "allow")
+	}
+
+	denied.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := denied.ReadFrom(b); err == nil {
+		t.Error("denied target received a datagram")
+	}
+}
+
+func TestServerDenyIPv6DropsDatagram(t *testing.T) {
+	relay := listenUDP(t)
+	target := listenUDP(t)
+	port := target.LocalAddr().(*net.UDPAddr).Port
+	s := &Server{
+		DenyIPv6: true,
+		Resolver: mapResolver{"v4.test": net.IPv4(127, 0, 0, 1), "v6.test": net.IPv6loopback},
+	}
+
+	for _, addr := range []*Addr{
+		{Type: AddrIPv6, Host: "::1", Port: uint16(port)},
+		{Type: AddrDomain, Host: "v6.test", Port: uint16(port)},
+	} {
+		b, err := NewUDPDatagram(NewUDPHeader(0, 0, addr), []byte("v6")).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent, err := s.forwardUDP(relay, b); err != nil || sent != nil {
+			t.Errorf("forwardUDP to %v = %v, %v, want it dropped", addr, sent, err)
+		}
+	}
+	if n := s.DroppedDatagrams(); n != 2 {
+		t.Errorf("DroppedDatagrams() = %d, want 2", n)
+	}
+
+	// names go through the Resolver, as for CONNECT
+	b, err := NewUDPDatagram(NewUDPHeader(0, 0, &Addr{Type: AddrDomain, Host: "v4.test", Port: uint16(port)}), []byte("v4")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent, err := s.forwardUDP(relay, b); err != nil || sent == nil {
+		t.Fatalf("forwardUDP to v4.test = %v, %v", sent, err)
+	}
+	buf := make([]byte, 16)
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := target.ReadFrom(buf); err != nil || string(buf[:n]) != "v4" {
+		t.Errorf("target got %q, %v, want %q", buf[:n], err, "v4")
+	}
+}
+
+func TestParseUDPDatagram(t *testing.T) {
+	b := []byte{0, 0, 1, AddrDomain, 4, 'h', 'o', 's', 't', 0, 53, 'h', 'i'}
+
+	dgram, err := ParseUDPDatagram(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgram.Header.Frag != 1 || dgram.Header.Addr.String() != "host:53" {
+		t.Errorf("header = %v", dgram.Header)
+	}
+	if string(dgram.Data) != "hi" {
+		t.Errorf("data = %q, want %q", dgram.Data, "hi")
+	}
+
+	for n := 0; n < 11; n++ {
+		if _, err := ParseUDPDatagram(b[:n]); !errors.Is(err, ErrShortBuffer) {
+			t.Errorf("%d byte header: %v, want %v", n, err, ErrShortBuffer)
+		}
+	}
+	if _, err := ParseUDPDatagram([]byte{0, 0, 0, 0x07, 0, 0}); !errors.Is(err, ErrBadAddrType) {
+		t.Errorf("unknown address type: %v, want %v", err, ErrBadAddrType)
+	}
+}
+
+func TestReadUDPDatagramMaxSize(t *testing.T) {
+	header := []byte{0, 0, 0, AddrIPv4, 127, 0, 0, 1, 0, 53} // 10 bytes
+	opts := &DecodeOptions{MaxUDPDatagramSize: 20}
+
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"at limit", append(header, bytes.Repeat([]byte{'x'}, 10)...), nil},
+		{"over limit", append(header, bytes.Repeat([]byte{'x'}, 11)...), ErrShortBuffer},
+		{"tunnelled over limit", append([]byte{0, 11}, header[2:]...), ErrShortBuffer},
+	}
+	for _, tt := range tests {
+		if _, err := ReadUDPDatagramWithOptions(bytes.NewReader(tt.b), opts); !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// allocPerCall returns the average number of bytes f allocates per call.
+func allocPerCall(f func()) uint64 {
+	const runs = 100
+	f() // warm up pools
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < runs; i++ {
+		f()
+	}
+	runtime.ReadMemStats(&after)
+	return (after.TotalAlloc - before.TotalAlloc) / runs
+}
+
+func TestReadUDPDatagramStream(t *testing.T) {
+	addr := &Addr{Type: AddrDomain, Host: "example.com", Port: 53}
+	var stream bytes.Buffer
+	for _, data := range []string{"one", "two"} {
+		d := NewUDPDatagram(NewUDPHeader(uint16(len(data)), 0, addr), []byte(data))
+		if err := d.Write(&stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.WriteString("rest")
+
+	r := bufio.NewReader(&stream)
+	for _, want := range []string{"one", "two"} {
+		d, err := ReadUDPDatagram(r)
+		if err != nil {
+			t.Fatalf("ReadUDPDatagram for %q: %v", want, err)
+		}
+		if string(d.Data) != want || *d.Header.Addr != *addr {
+			t.Errorf("ReadUDPDatagram = %v %q, want %q", d.Header, d.Data, want)
+		}
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+		t.Errorf("left %q on the stream, want %q", rest, "rest")
+	}
+}
+
+func TestUDPDatagramStrictRSV(t *testing.T) {
+	addr := &Addr{Type: AddrIPv4, Host: "192.0.2.1", Port: 53}
+	strict := &DecodeOptions{StrictRSV: true}
+	for _, tt := range []struct {
+		rsv    uint16
+		frag   uint8
+		strict bool // accepted under StrictRSV
+	}{
+		{0, 0, true},
+		{0x1234, 0, false},
+		{0, 0x01, true},
+		{0, 0x81, true},
+		{0, 0x80, false},
+	} {
+		b, err := NewUDPDatagram(NewUDPHeader(tt.rsv, tt.frag, addr), []byte("data")).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := ParseUDPDatagram(b)
+		if err != nil || d.Header.Rsv != tt.rsv || d.Header.Frag != tt.frag || string(d.Data) != "data" {
+			t.Errorf("RSV %#x FRAG %#x: ParseUDPDatagram = %v, %v", tt.rsv, tt.frag, d, err)
+		}
+
+		var wantErr error
+		if !tt.strict {
+			wantErr = ErrBadFormat
+		}
+		if _, err := ParseUDPDatagramWithOptions(b, strict); !errors.Is(err, wantErr) {
+			t.Errorf("RSV %#x FRAG %#x: ParseUDPDatagramWithOptions, StrictRSV: %v, want %v", tt.rsv, tt.frag, err, wantErr)
+		}
+		if _, err := ReadUDPDatagramWithOptions(bytes.NewReader(b), strict); !errors.Is(err, wantErr) {
+			t.Errorf("RSV %#x FRAG %#x: ReadUDPDatagramWithOptions, StrictRSV: %v, want %v", tt.rsv, tt.frag, err, wantErr)
+		}
+	}
+
+	// and the relay of a Server under Config.DecodeOptions
+	target := listenUDP(t)
+	dst, err := NewAddrFromNetAddr(target.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewUDPDatagram(NewUDPHeader(0x1234, 0, dst), []byte("data")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Config: &Config{DecodeOptions: strict}}
+	if sent, err := s.forwardUDP(listenUDP(t), b); !errors.Is(err, ErrBadFormat) || sent != nil {
+		t.Errorf("forwardUDP, StrictRSV: %v, %v, want %v", sent, err, ErrBadFormat)
+	}
+}
+
+func TestAppendUDPDatagrams(t *testing.T) {
+	var ds []*UDPDatagram
+	var want []byte
+	for i, addr := range append(roundTripAddrs, nil) {
+		d := NewUDPDatagram(NewUDPHeader(uint16(i), 0, addr), bytes.Repeat([]byte{'x'}, i))
+		b, err := d.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != udpFrameLen(d) {
+			t.Errorf("udpFrameLen(%v) = %d, want %d", addr, udpFrameLen(d), len(b))
+		}
+		ds = append(ds, d)
+		want = append(want, b...)
+	}
+
+	got, err := AppendUDPDatagrams([]byte("prefix"), ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[len("prefix"):], want) {
+		t.Errorf("AppendUDPDatagrams = % x, want % x", got[len("prefix"):], want)
+	}
+
+	// the race detector adds allocations of its own
+	if !raceEnabled {
+		buf := make([]byte, 0, len(want))
+		if n := testing.AllocsPerRun(10, func() { AppendUDPDatagrams(buf, ds) }); n != 0 {
+			t.Errorf("AppendUDPDatagrams into a large enough buffer: %v allocs, want 0", n)
+		}
+		if n := testing.AllocsPerRun(10, func() { AppendUDPDatagrams(nil, ds) }); n != 1 {
+			t.Errorf("AppendUDPDatagrams(nil): %v allocs, want 1", n)
+		}
+	}
+
+	bad := NewUDPDatagram(NewUDPHeader(0, 0, &Addr{Type: AddrIPv4, Host: "example.com"}), nil)
+	got, err = AppendUDPDatagrams(nil, []*UDPDatagram{ds[0], bad, ds[1]})
+	if err != ErrBadFormat {
+		t.Errorf("AppendUDPDatagrams with a bad address: %v, want %v", err, ErrBadFormat)
+	}
+	if first, _ := ds[0].MarshalBinary(); !bytes.Equal(got, first) {
+		t.Errorf("AppendUDPDatagrams with a bad address = % x, want the datagram before it", got)
+	}
+}
+
+func TestAppendUDPDatagramsStream(t *testing.T) {
+	var ds []*UDPDatagram
+	for i, addr := range roundTripAddrs {
+		data := bytes.Repeat([]byte{'a' + byte(i)}, i+1)
+		ds = append(ds, NewUDPDatagram(NewUDPHeader(uint16(len(data)), 0, addr), data))
+	}
+	b, err := AppendUDPDatagrams(nil, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one reader over the whole burst, as over a TCP tunnel
+	r := bufio.NewReader(bytes.NewReader(b))
+	for _, want := range ds {
+		d, err := ReadUDPDatagram(r)
+		if err != nil {
+			t.Fatalf("ReadUDPDatagram for %v: %v", want.Header.Addr, err)
+		}
+		if !bytes.Equal(d.Data, want.Data) || *d.Header.Addr != *want.Header.Addr {
+			t.Errorf("ReadUDPDatagram = %v %q, want %v %q", d.Header, d.Data, want.Header, want.Data)
+		}
+	}
+	if _, err := ReadUDPDatagram(r); err != io.EOF {
+		t.Errorf("ReadUDPDatagram past the burst: %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadAllocBound(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool does not keep buffers under the race detector")
+	}
+	// what a malformed frame may cost, the largest frame buffer and the error
+	const bound = 1024
+
+	tests := []struct {
+		name string
+		read func(io.Reader) error
+		b    []byte
+	}{
+		{"datagram with RSV length past the end", func(r io.Reader) error {
+			_, err := ReadUDPDatagram(r)
+			return err
+		}, []byte{0xFF, 0xFF, 0, AddrIPv4, 127, 0, 0, 1, 0, 53}},
+		{"datagram with bad address type", func(r io.Reader) error {
+			_, err := ReadUDPDatagram(r)
+			return err
+		}, []byte{0, 0, 0, 0x07, 0, 0, 0, 0, 0, 0}},
+		{"datagram with short domain", func(r io.Reader) error {
+			_, err := ReadUDPDatagram(r)
+			return err
+		}, []byte{0, 0, 0, AddrDomain, 255, 'a'}},
+		{"methods", func(r io.Reader) error {
+			_, err := ReadMethods(r)
+			return err
+		}, []byte{Ver5, 255, MethodNoAuth}},
+		{"user/pass request", func(r io.Reader) error {
+			_, err := ReadUserPassRequest(r)
+			return err
+		}, []byte{UserPassVer, 255, 'a'}},
+		{"request", func(r io.Reader) error {
+			_, err := ReadRequest(r)
+			return err
+		}, []byte{Ver5, CmdConnect, 0, AddrDomain, 255, 'a'}},
+		{"reply", func(r io.Reader) error {
+			_, err := ReadReply(r)
+			return err
+		}, []byte{Ver5, Succeeded, 0, AddrDomain, 255, 'a'}},
+	}
+	for _, tt := range tests {
+		r := bytes.NewReader(tt.b)
+		n := allocPerCall(func() {
+			r.Reset(tt.b)
+			if err := tt.read(r); err == nil {
+				t.Fatalf("%s: no error", tt.name)
+			}
+		})
+		if n > bound {
+			t.Errorf("%s: %d bytes allocated per call, want at most %d", tt.name, n, bound)
+		}
+	}
+
+	// a valid datagram costs about what it returns, whatever the limit
+	frame := append([]byte{0, 0, 0, AddrIPv4, 127, 0, 0, 1, 0, 53}, "payload"...)
+	r := bytes.NewReader(frame)
+	n := allocPerCall(func() {
+		r.Reset(frame)
+		if _, err := ReadUDPDatagram(r); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if n > bound {
+		t.Errorf("valid datagram: %d bytes allocated per call, want at most %d", n, bound)
+	}
+}
+
+func TestServerServeUDP(t *testing.T) {
+	relay := listenUDP(t)
+	client := listenUDP(t)
+	target := listenUDP(t)
+	spoofer := listenUDP(t)
+
+	s := &Server{}
+	done := make(chan error, 1)
+	go func() { done <- s.serveUDP(relay, client.LocalAddr()) }()
+
+	b := make([]byte, 512)
+	read := func(c net.PacketConn, d time.Duration) ([]byte, net.Addr, error) {
+		c.SetReadDeadline(time.Now().Add(d))
+		n, from, err := c.ReadFrom(b)
+		return b[:n], from, err
+	}
+
+	// a target the client has not sent to cannot reach the client
+	spoofer.WriteTo([]byte("spoof"), relay.LocalAddr())
+
+	client.WriteTo(encodeDatagram(t, target.LocalAddr(), []byte("ping")), relay.LocalAddr())
+	data, from, err := read(target, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ping" {
+		t.Errorf("target got %q, want %q", data, "ping")
+	}
+
+	target.WriteTo([]byte("pong"), from)
+	data, _, err = read(client, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgram, err := ParseUDPDatagram(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dgram.Data) != "pong" || dgram.Header.Addr.String() != target.LocalAddr().String() {
+		t.Errorf("client got %q from %s, want %q from %s",
+			dgram.Data, dgram.Header.Addr, "pong", target.LocalAddr())
+	}
+
+	// the client's address may not be used by others to send to targets
+	spoofer.WriteTo(encodeDatagram(t, target.LocalAddr(), []byte("spoof")), relay.LocalAddr())
+	if data, _, err := read(target, 50*time.Millisecond); err == nil {
+		t.Errorf("target got %q from a spoofed source", data)
+	}
+	if data, _, err := read(client, 50*time.Millisecond); err == nil {
+		t.Errorf("client got %q from a spoofed source", data)
+	}
+
+	relay.Close()
+	if err := <-done; err != nil {
+		t.Errorf("serveUDP: %v", err)
+	}
+}
+
+func TestServerServeUDPMaxSize(t *testing.T) {
+	relay := listenUDP(t)
+	client := listenUDP(t)
+	target := listenUDP(t)
+
+	small := encodeDatagram(t, target.LocalAddr(), []byte("ping"))
+	s := &Server{Config: &Config{DecodeOptions: &DecodeOptions{MaxUDPDatagramSize: len(small)}}}
+	done := make(chan error, 1)
+	go func() { done <- s.serveUDP(relay, client.LocalAddr()) }()
+
+	b := make([]byte, 512)
+	client.WriteTo(encodeDatagram(t, target.LocalAddr(), []byte("too large")), relay.LocalAddr())
+	client.WriteTo(small, relay.LocalAddr())
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := target.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "ping" {
+		t.Errorf("target got %q first, want the datagram within the limit", b[:n])
+	}
+
+	relay.Close()
+	if err := <-done; err != nil {
+		t.Errorf("serveUDP: %v", err)
+	}
+}
+
+func TestUDPDatagramAppendBinary(t *testing.T) {
+	for _, addr := range roundTripAddrs {
+		d := NewUDPDatagram(NewUDPHeader(0, 1, addr), []byte("payload"))
+
+		buf := &bytes.Buffer{}
+		if err := d.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		b, err := d.AppendBinary([]byte("prefix"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[len("prefix"):], buf.Bytes()) {
+			t.Errorf("AppendBinary = % x, Write = % x", b[len("prefix"):], buf.Bytes())
+		}
+
+		got, err := ParseUDPDatagram(buf.Bytes())
+		if err != nil {
+			t.Fatalf("ParseUDPDatagram(%v): %v", addr, err)
+		}
+		if got.Header.Frag != 1 || *got.Header.Addr != *addr || string(got.Data) != "payload" {
+			t.Errorf("round trip of %v = %v %q", addr, got.Header, got.Data)
+		}
+
+		// and over a stream, as one read or with the length in RSV
+		tunnelled := NewUDPDatagram(NewUDPHeader(uint16(len("payload")), 1, addr), []byte("payload"))
+		for _, d := range []*UDPDatagram{d, tunnelled} {
+			b, err := d.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadUDPDatagram(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("ReadUDPDatagram(%v): %v", d.Header, err)
+			}
+			if got.Header.Rsv != d.Header.Rsv || got.Header.Frag != 1 || *got.Header.Addr != *addr || string(got.Data) != "payload" {
+				t.Errorf("stream round trip of %v = %v %q", d.Header, got.Header, got.Data)
+			}
+		}
+	}
+
+	// the layout matches a frame assembled by hand
+	d := NewUDPDatagram(NewUDPHeader(0, 0, &Addr{Type: AddrDomain, Host: gosocks5test.Domain, Port: gosocks5test.Port}), []byte(gosocks5test.Payload))
+	if b, err := d.MarshalBinary(); err != nil || !bytes.Equal(b, gosocks5test.UDPDatagram()) {
+		t.Errorf("MarshalBinary = % x, %v, want % x", b, err, gosocks5test.UDPDatagram())
+	}
+
+	if _, err := NewUDPDatagram(nil, nil).MarshalBinary(); err != nil {
+		t.Errorf("nil header: %v", err)
+	}
+
+	d = NewUDPDatagram(NewUDPHeader(0, 0, roundTripAddrs[0]), make([]byte, 512))
+	buf := make([]byte, 0, 1024)
+	if allocs := testing.AllocsPerRun(100, func() { d.AppendBinary(buf[:0]) }); allocs != 0 {
+		t.Errorf("AppendBinary into a large enough buffer allocated %v times", allocs)
+	}
+}